@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// nansible-inventory is an ansible dynamic inventory script that gets the hosts
+// and groups from the nansibled API, use it with ansible-playbook -i nansible-inventory
+func main() {
+	var list bool
+	var hostname, apiURL, apiKey string
+	flag.BoolVar(&list, "list", false, "print the whole inventory")
+	flag.StringVar(&hostname, "host", "", "print the vars for the host")
+	flag.StringVar(&apiURL, "u", os.Getenv("NANSIBLE_URL"), "the URL of the nansibled API")
+	flag.StringVar(&apiKey, "k", os.Getenv("NANSIBLE_API_KEY"), "the key to access the API with")
+	flag.Parse()
+
+	if apiURL == "" {
+		apiURL = "http://127.0.0.1:8090"
+	}
+
+	if !list && hostname == "" {
+		fmt.Fprintln(os.Stderr, "usage: nansible-inventory --list | --host <name>")
+		os.Exit(2)
+	}
+
+	q := url.Values{}
+	if hostname != "" {
+		q.Set("host", hostname)
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(apiURL, "/")+"/inventory?"+q.Encode(), nil)
+	if err != nil {
+		fail(err)
+	}
+	req.Header.Set("X-Api-Key", apiKey)
+
+	res, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		fail(err)
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		fail(err)
+	}
+
+	if res.StatusCode != 200 {
+		fail(fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(data))))
+	}
+
+	os.Stdout.Write(data)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "ERROR:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name string
+	typ  byte
+	mode int64
+	body string
+}
+
+func makeBundle(t *testing.T, entries ...tarEntry) string {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Mode: e.mode}
+		switch e.typ {
+		case tar.TypeReg:
+			hdr.Size = int64(len(e.body))
+		case tar.TypeSymlink, tar.TypeLink:
+			hdr.Linkname = e.body
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte(e.body))
+		}
+	}
+	tw.Close()
+	zw.Close()
+	return buf.String()
+}
+
+func TestStageBundle(t *testing.T) {
+	st := stager{dir: t.TempDir(), keep: 5}
+	pb := makeBundle(t,
+		tarEntry{"roles/", tar.TypeDir, 0777, ""},
+		tarEntry{"roles/web/tasks/main.yml", tar.TypeReg, 0666, "- ping:"},
+		tarEntry{"files/run.sh", tar.TypeReg, 0775, "#!/bin/sh"},
+		tarEntry{"files/secret", tar.TypeReg, 0400, "x"},
+		tarEntry{"deploy/site.yml", tar.TypeReg, 0644, testPlaybook},
+	)
+
+	dir, err := st.stage("d1", "./deploy/site.yml", pb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, bundleDir)
+	if pbPath, wd := playbookPath(dir); pbPath != filepath.Join(root, "deploy", "site.yml") || wd != root {
+		t.Errorf("playbookPath = %s, %s", pbPath, wd)
+	}
+
+	// executable bits are kept, nothing is writable by others and everything is
+	// readable by the agent
+	modes := map[string]os.FileMode{
+		"roles":                    0755,
+		"roles/web/tasks/main.yml": 0644,
+		"files/run.sh":             0755,
+		"files/secret":             0600,
+		"deploy/site.yml":          0644,
+	}
+	for name, want := range modes {
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("mode of %s = %v, want %v", name, info.Mode().Perm(), want)
+		}
+	}
+
+	if sum, _ := os.ReadFile(filepath.Join(dir, checksumFile)); string(sum) != md5PB(pb, "./deploy/site.yml") {
+		t.Error("checksum was not written for the bundle")
+	}
+}
+
+func TestStageBundleInvalid(t *testing.T) {
+	site := tarEntry{"site.yml", tar.TypeReg, 0644, testPlaybook}
+	tests := []struct {
+		desc       string
+		entrypoint string
+		entries    []tarEntry
+	}{
+		{"traversal", "site.yml", []tarEntry{site, {"../../escaped", tar.TypeReg, 0644, "x"}}},
+		{"absolute", "site.yml", []tarEntry{site, {"/tmp/escaped", tar.TypeReg, 0644, "x"}}},
+		{"symlink", "site.yml", []tarEntry{site, {"link", tar.TypeSymlink, 0777, "/etc/passwd"}}},
+		{"hard link", "site.yml", []tarEntry{site, {"link", tar.TypeLink, 0644, "/etc/passwd"}}},
+		{"device", "site.yml", []tarEntry{site, {"dev", tar.TypeChar, 0644, ""}}},
+		{"missing entrypoint", "other.yml", []tarEntry{site}},
+		{"entrypoint outside", "../site.yml", []tarEntry{site}},
+		{"bad entrypoint", "site.yml", []tarEntry{{"site.yml", tar.TypeReg, 0644, "hosts: ["}}},
+	}
+
+	for _, tt := range tests {
+		parent := t.TempDir()
+		st := stager{dir: parent, keep: 5}
+		if _, err := st.stage("d1", tt.entrypoint, makeBundle(t, tt.entries...), nil); err == nil {
+			t.Errorf("%s: expected an error", tt.desc)
+		}
+
+		if _, err := os.Stat(filepath.Join(st.deploysDir(), "d1")); !os.IsNotExist(err) {
+			t.Errorf("%s: the deploy directory was left behind", tt.desc)
+		}
+
+		for _, escaped := range []string{filepath.Join(parent, "escaped"), filepath.Join(st.deploysDir(), "escaped")} {
+			if _, err := os.Stat(escaped); err == nil {
+				t.Errorf("%s: a file was written outside the bundle", tt.desc)
+			}
+		}
+	}
+
+	if _, err := (stager{dir: t.TempDir()}).stage("d1", "site.yml", "not a bundle", nil); err == nil {
+		t.Error("expected an error for a payload that isn't a bundle")
+	}
+}
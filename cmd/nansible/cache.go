@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errNotCached = errors.New("playbook is not cached")
+
+// cache keeps received playbooks and bundles on disk by the hash of their content
+// so the server doesn't have to send them again, once it is bigger than max the
+// least recently used ones are removed
+type cache struct {
+	mu  sync.Mutex
+	dir string
+	max int64
+}
+
+func (ch *cache) path(hash string) (string, error) {
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+		return "", errors.New("invalid playbook hash")
+	}
+	return filepath.Join(ch.dir, hash), nil
+}
+
+// get returns the cached content with the given hash, marking it as used
+func (ch *cache) get(hash string) ([]byte, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	fn, err := ch.path(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, errNotCached
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	os.Chtimes(fn, now, now)
+	return data, nil
+}
+
+// put adds the content to the cache under its hash, and evicts the least recently
+// used content if the cache is too big
+func (ch *cache) put(hash string, data []byte) error {
+	if ch.max <= 0 || int64(len(data)) > ch.max {
+		return nil
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	fn, err := ch.path(hash)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(ch.dir, 0700); err != nil {
+		return err
+	}
+
+	tmp := fn + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	ch.evict()
+	return nil
+}
+
+func (ch *cache) evict() {
+	entries, err := os.ReadDir(ch.dir)
+	if err != nil {
+		log.Println("ERROR: failed to evict from cache:", err)
+		return
+	}
+
+	type cached struct {
+		path string
+		size int64
+		used int64
+	}
+
+	var total int64
+	var files []cached
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		total += info.Size()
+		files = append(files, cached{filepath.Join(ch.dir, e.Name()), info.Size(), info.ModTime().UnixNano()})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].used < files[j].used })
+
+	for _, f := range files {
+		if total <= ch.max {
+			return
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			log.Println("ERROR: failed to evict from cache:", err)
+			continue
+		}
+		total -= f.size
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+)
+
+func TestCacheGetPut(t *testing.T) {
+	ch := &cache{dir: filepath.Join(t.TempDir(), "cache"), max: 1 << 20}
+
+	data := []byte("- hosts: all")
+	hash := nansibled.Checksum(data)
+
+	if _, err := ch.get(hash); err != errNotCached {
+		t.Fatalf("get before put = %v, want errNotCached", err)
+	}
+
+	if err := ch.put(hash, data); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ch.get(hash)
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("get = %q, %v", got, err)
+	}
+
+	for _, bad := range []string{"", "../../etc/passwd", strings.Repeat("z", 64), hash[:32]} {
+		if _, err := ch.get(bad); err == nil || err == errNotCached {
+			t.Errorf("get(%q) = %v, want an invalid hash error", bad, err)
+		}
+		if err := ch.put(bad, data); err == nil {
+			t.Errorf("put(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	ch := &cache{dir: t.TempDir(), max: 25}
+
+	put := func(body string, age time.Duration) string {
+		hash := nansibled.Checksum([]byte(body))
+		if err := ch.put(hash, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		used := time.Now().Add(-age)
+		os.Chtimes(filepath.Join(ch.dir, hash), used, used)
+		return hash
+	}
+
+	oldest := put("0123456789", 3*time.Hour)
+	older := put("abcdefghij", 2*time.Hour)
+
+	// using the oldest makes the other one the least recently used
+	if _, err := ch.get(oldest); err != nil {
+		t.Fatal(err)
+	}
+
+	newest := put("ABCDEFGHIJ", time.Hour)
+
+	if _, err := ch.get(older); err != errNotCached {
+		t.Errorf("least recently used content was not evicted: %v", err)
+	}
+
+	for _, hash := range []string{oldest, newest} {
+		if _, err := ch.get(hash); err != nil {
+			t.Errorf("recently used content was evicted: %v", err)
+		}
+	}
+}
+
+func TestCacheSkipsWhatDoesNotFit(t *testing.T) {
+	for _, max := range []int64{0, 4} {
+		ch := &cache{dir: t.TempDir(), max: max}
+		data := []byte("too big for the cache")
+		hash := nansibled.Checksum(data)
+
+		if err := ch.put(hash, data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ch.get(hash); err != errNotCached {
+			t.Errorf("max %d: content was cached: %v", max, err)
+		}
+	}
+}
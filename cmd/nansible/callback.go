@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	resultsCallback = "nansible_results"
+	resultsFile     = "results.json"
+	pluginsDir      = "callback_plugins"
+)
+
+// resultsCallbackSource is an ansible callback that writes what the json stdout
+// callback would have printed to the file in NANSIBLE_RESULTS_FILE instead
+const resultsCallbackSource = `import os
+
+from ansible.plugins.loader import callback_loader
+
+JSONCallback = callback_loader.get('ansible.posix.json', class_only=True) or callback_loader.get('json', class_only=True)
+
+
+class ResultsFile(object):
+    def display(self, msg, *args, **kwargs):
+        with open(os.environ['NANSIBLE_RESULTS_FILE'], 'w') as f:
+            f.write(msg)
+
+
+class CallbackModule(JSONCallback):
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = 'aggregate'
+    CALLBACK_NAME = 'nansible_results'
+    CALLBACK_NEEDS_ENABLED = True
+    CALLBACK_NEEDS_WHITELIST = True
+
+    def get_option(self, k):
+        try:
+            return super(CallbackModule, self).get_option(k)
+        except KeyError:
+            return None
+
+    def v2_playbook_on_stats(self, stats):
+        display = self._display
+        self._display = ResultsFile()
+        try:
+            super(CallbackModule, self).v2_playbook_on_stats(stats)
+        finally:
+            self._display = display
+`
+
+// writeResultsCallback puts the results callback in the staged directory, and
+// returns the plugin directory and the file the results will be written to
+func writeResultsCallback(dir string) (string, string, error) {
+	plugins := filepath.Join(dir, pluginsDir)
+	if err := os.MkdirAll(plugins, 0700); err != nil {
+		return "", "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(plugins, resultsCallback+".py"), []byte(resultsCallbackSource), 0600); err != nil {
+		return "", "", err
+	}
+
+	results := filepath.Join(dir, resultsFile)
+	if err := os.Remove(results); err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+
+	return plugins, results, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+	"gopkg.in/yaml.v2"
+)
+
+var configFile = "/etc/nansible/nansible.yml"
+
+type config struct {
+	NatsURL string `yaml:"nats_url"`
+	KeyFile string `yaml:"key_file"`
+
+	// TrustedKeys are the public keys of the server that messages must be signed
+	// with, list the old and new keys here while the server key is being rotated
+	TrustedKeys []string `yaml:"trusted_keys"`
+
+	StateDir    string `yaml:"state_dir"`
+	KeepDeploys int    `yaml:"keep_deploys"`
+
+	// RollbackOnFailure reapplies the last good playbook when a deploy fails, even
+	// if the deploy didn't ask for it
+	RollbackOnFailure bool `yaml:"rollback_on_failure"`
+
+	// CancelGrace is how long ansible gets to stop after being cancelled before it is killed
+	CancelGrace time.Duration `yaml:"cancel_grace"`
+
+	// Labels are set on the host when it answers a ping, overriding any labels
+	// with the same key that were set through the API
+	Labels map[string]string `yaml:"labels"`
+
+	// ChunkTimeout is how long to wait for each chunk of a payload that is too big
+	// to be sent in the deploy, and FetchRetry how long to keep trying without one
+	ChunkTimeout time.Duration `yaml:"chunk_timeout"`
+	FetchRetry   time.Duration `yaml:"fetch_retry"`
+
+	// CacheSize is how many bytes of received playbooks are kept so that they don't
+	// have to be sent again, zero turns the cache off
+	CacheSize int64 `yaml:"cache_size"`
+
+	NonceFile string        `yaml:"nonce_file"`
+	MaxNonces int           `yaml:"max_nonces"`
+	ClockSkew time.Duration `yaml:"clock_skew"`
+}
+
+func loadConfig(fn string) (*config, error) {
+	cfg := &config{
+		NatsURL: nats.DefaultURL,
+		KeyFile: keyFile,
+
+		StateDir:    "/var/lib/nansible",
+		KeepDeploys: 5,
+		CancelGrace: 30 * time.Second,
+
+		ChunkTimeout: 10 * time.Second,
+		FetchRetry:   2 * time.Minute,
+		CacheSize:    256 << 20,
+
+		NonceFile: "/var/lib/nansible/nonces.json",
+		MaxNonces: 10000,
+		ClockSkew: time.Minute,
+	}
+
+	data, err := os.ReadFile(fn)
+	switch {
+	case os.IsNotExist(err):
+		return cfg, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxNonces <= 0 {
+		return nil, errors.New("max_nonces must be more than 0")
+	}
+
+	return cfg, nil
+}
+
+func (cfg *config) trustedKeys() ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, s := range cfg.TrustedKeys {
+		k, err := nansibled.ParsePublicKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
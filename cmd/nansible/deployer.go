@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+)
+
+var (
+	errNotRunning = errors.New("deploy is not running")
+	errCancelled  = errors.New("deploy was cancelled")
+)
+
+// deployer runs one playbook at a time and can cancel the one that is running
+type deployer struct {
+	mu    sync.Mutex
+	grace time.Duration
+
+	cmu       sync.Mutex
+	id        string
+	curr      *exec.Cmd
+	exited    chan struct{}
+	cancelled bool
+}
+
+// Cancel stops the running deploy by sending SIGTERM to the ansible process group,
+// and then SIGKILL if it hasn't exited after the grace period
+func (dp *deployer) Cancel(id string) error {
+	dp.cmu.Lock()
+	if dp.curr == nil || dp.curr.Process == nil || dp.id != id {
+		dp.cmu.Unlock()
+		return errNotRunning
+	}
+
+	dp.cancelled = true
+	pgid := -dp.curr.Process.Pid
+	exited := dp.exited
+	dp.cmu.Unlock()
+
+	if err := syscall.Kill(pgid, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	go func() {
+		select {
+		case <-exited:
+		case <-time.After(dp.grace):
+			log.Println("WARN: ansible didn't stop after", dp.grace, "killing it")
+			syscall.Kill(pgid, syscall.SIGKILL)
+		}
+	}()
+
+	return nil
+}
+
+// Deploy runs the playbook in the staged directory, calling onLine with each line
+// of output as it is written, the per task results are parsed from the json callback
+func (dp *deployer) Deploy(id, dir string, onLine func(string)) ([]byte, *nansibled.DeployResult, error) {
+	return dp.run(id, dir, onLine)
+}
+
+// Check runs the playbook in the staged directory in check mode, the results
+// show what would have changed along with the diffs
+func (dp *deployer) Check(id, dir string) ([]byte, *nansibled.DeployResult, error) {
+	return dp.run(id, dir, func(string) {}, "--check", "--diff")
+}
+
+func (dp *deployer) run(id, dir string, onLine func(string), args ...string) ([]byte, *nansibled.DeployResult, error) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+
+	yml, wd := playbookPath(dir)
+	args = append([]string{yml, "-i", "127.0.0.1,"}, args...)
+	if _, err := os.Stat(filepath.Join(dir, varsFile)); err == nil {
+		args = append(args, "--extra-vars", "@"+filepath.Join(dir, varsFile))
+	}
+	// stdout stays on the default callback so it can be streamed line by line, the
+	// structured results are written to a file by the results callback
+	plugins, results, err := writeResultsCallback(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command("ansible-playbook", args...)
+	cmd.Dir = wd
+	cmd.Env = append(os.Environ(),
+		"ANSIBLE_CALLBACK_PLUGINS="+plugins,
+		"ANSIBLE_CALLBACKS_ENABLED="+resultsCallback,
+		"ANSIBLE_CALLBACK_WHITELIST="+resultsCallback,
+		"NANSIBLE_RESULTS_FILE="+results,
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	buf := bytes.NewBufferString("")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scn := bufio.NewScanner(pr)
+		scn.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scn.Scan() {
+			buf.WriteString(scn.Text() + "\n")
+			onLine(scn.Text())
+		}
+		io.Copy(io.Discard, pr)
+	}()
+
+	err = dp.start(id, cmd)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	cancelled := dp.finish()
+
+	pw.Close()
+	<-done
+
+	var res *nansibled.DeployResult
+	data, rerr := os.ReadFile(results)
+	if rerr == nil {
+		res, rerr = nansibled.ParseAnsibleJSON(data)
+	}
+	if rerr != nil {
+		log.Println("ERROR: failed to parse ansible results:", rerr)
+	}
+
+	if cancelled {
+		err = errCancelled
+	}
+
+	return buf.Bytes(), res, err
+}
+
+func (dp *deployer) start(id string, cmd *exec.Cmd) error {
+	dp.cmu.Lock()
+	defer dp.cmu.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	dp.id = id
+	dp.curr = cmd
+	dp.exited = make(chan struct{})
+	dp.cancelled = false
+	return nil
+}
+
+// finish clears the running process and returns true if it was cancelled
+func (dp *deployer) finish() bool {
+	dp.cmu.Lock()
+	defer dp.cmu.Unlock()
+
+	if dp.exited != nil {
+		close(dp.exited)
+	}
+
+	cancelled := dp.cancelled
+	dp.id = ""
+	dp.curr = nil
+	dp.exited = nil
+	dp.cancelled = false
+	return cancelled
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+)
+
+// gatherFacts uses ansible's setup module to get the facts, falling back to the
+// builtin collector when ansible can't be run
+func gatherFacts(host string) *nansibled.Facts {
+	facts, err := setupFacts()
+	if err != nil {
+		facts = builtinFacts()
+	}
+
+	facts.Hostname = host
+	facts.CollectedAt = time.Now()
+	return facts
+}
+
+func setupFacts() (*nansibled.Facts, error) {
+	out, err := exec.Command("ansible", "localhost", "-c", "local", "-m", "setup", "-o").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// the output looks like "localhost | SUCCESS => {...}"
+	i := bytes.Index(out, []byte("=> {"))
+	if i < 0 {
+		return nil, errors.New("no json found in setup output")
+	}
+
+	var res struct {
+		Facts struct {
+			System              string   `json:"ansible_system"`
+			OSFamily            string   `json:"ansible_os_family"`
+			Distribution        string   `json:"ansible_distribution"`
+			DistributionVersion string   `json:"ansible_distribution_version"`
+			Kernel              string   `json:"ansible_kernel"`
+			Arch                string   `json:"ansible_architecture"`
+			IPv4                []string `json:"ansible_all_ipv4_addresses"`
+			IPv6                []string `json:"ansible_all_ipv6_addresses"`
+			CPUs                int      `json:"ansible_processor_vcpus"`
+			MemoryMB            int      `json:"ansible_memtotal_mb"`
+		} `json:"ansible_facts"`
+	}
+
+	if err := json.Unmarshal(out[i+3:], &res); err != nil {
+		return nil, err
+	}
+
+	f := res.Facts
+	return &nansibled.Facts{
+		OS:                  strings.ToLower(f.System),
+		OSFamily:            f.OSFamily,
+		Distribution:        f.Distribution,
+		DistributionVersion: f.DistributionVersion,
+		Kernel:              f.Kernel,
+		Arch:                f.Arch,
+		IPs:                 append(f.IPv4, f.IPv6...),
+		CPUs:                f.CPUs,
+		MemoryMB:            f.MemoryMB,
+		AnsibleVersion:      ansibleVersion(),
+		Source:              "setup",
+	}, nil
+}
+
+// builtinFacts gets what it can without ansible
+func builtinFacts() *nansibled.Facts {
+	facts := &nansibled.Facts{
+		OS:             runtime.GOOS,
+		Arch:           runtime.GOARCH,
+		CPUs:           runtime.NumCPU(),
+		AnsibleVersion: ansibleVersion(),
+		Source:         "builtin",
+	}
+
+	rel := osRelease()
+	facts.Distribution = rel["NAME"]
+	facts.DistributionVersion = rel["VERSION_ID"]
+	facts.OSFamily = osFamily(rel["ID"], rel["ID_LIKE"])
+
+	if data, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		facts.Kernel = strings.TrimSpace(string(data))
+	}
+
+	facts.MemoryMB = memTotalMB()
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.IsLoopback() || ipn.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			facts.IPs = append(facts.IPs, ipn.IP.String())
+		}
+	}
+
+	return facts
+}
+
+func osRelease() map[string]string {
+	rel := map[string]string{}
+	data, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		return rel
+	}
+
+	for _, l := range strings.Split(string(data), "\n") {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok {
+			continue
+		}
+		rel[k] = strings.Trim(v, `"'`)
+	}
+	return rel
+}
+
+// osFamily names the family the same way ansible does for the common distros
+func osFamily(id, like string) string {
+	for _, d := range append([]string{id}, strings.Fields(like)...) {
+		switch d {
+		case "debian", "ubuntu":
+			return "Debian"
+		case "rhel", "fedora", "centos":
+			return "RedHat"
+		case "suse", "opensuse":
+			return "Suse"
+		case "arch":
+			return "Archlinux"
+		case "alpine":
+			return "Alpine"
+		}
+	}
+	return ""
+}
+
+func memTotalMB() int {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scn := bufio.NewScanner(f)
+	for scn.Scan() {
+		fields := strings.Fields(scn.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.Atoi(fields[1])
+			return kb / 1024
+		}
+	}
+	return 0
+}
+
+func ansibleVersion() string {
+	out, err := exec.Command("ansible", "--version").Output()
+	if err != nil {
+		return ""
+	}
+
+	// the first line looks like "ansible [core 2.14.3]" or "ansible 2.9.6"
+	line := strings.SplitN(string(out), "\n", 2)[0]
+	line = strings.TrimPrefix(line, "ansible ")
+	line = strings.TrimPrefix(line, "[core ")
+	return strings.TrimSuffix(line, "]")
+}
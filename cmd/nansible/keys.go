@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+var keyFile = "/etc/nansible/key"
+
+// loadOrCreateKey loads the hosts private key from disk, generating and saving a new
+// one if it doesn't exist yet
+func loadOrCreateKey(fn string) (pub, priv *[32]byte, err error) {
+	data, err := os.ReadFile(fn)
+	switch {
+	case os.IsNotExist(err):
+		pub, priv, err = box.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			return nil, nil, err
+		}
+
+		err = os.WriteFile(fn, []byte(nansibled.EncodeKey(priv)+"\n"), 0600)
+		return pub, priv, err
+	case err != nil:
+		return nil, nil, err
+	}
+
+	priv, err = nansibled.ParseKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pub = new([32]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return pub, priv, nil
+}
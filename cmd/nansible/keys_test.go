@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+)
+
+func TestLoadOrCreateKey(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "etc", "key")
+
+	pub, priv, err := loadOrCreateKey(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	pub2, priv2, err := loadOrCreateKey(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pub2 != *pub || *priv2 != *priv {
+		t.Fatal("loading the saved key gave a different key")
+	}
+
+	// payloads sealed to the public key the agent reports can be opened with it
+	sealed, err := nansibled.SealPayload(nansibled.EncodeKey(pub2), []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := nansibled.OpenPayload(sealed, pub, priv); err != nil || string(data) != "data" {
+		t.Errorf("OpenPayload = %q, %v", data, err)
+	}
+
+	os.WriteFile(fn, []byte("garbage\n"), 0600)
+	if _, _, err := loadOrCreateKey(fn); err == nil {
+		t.Error("expected an error for an invalid key file")
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"os"
-	"os/exec"
-	"sync"
-	"syscall"
+	"path/filepath"
 
 	"github.com/nats-io/nats.go"
 	"github.com/penguinpowernz/nansible/pkg/nansibled"
@@ -14,13 +16,33 @@ import (
 func main() {
 
 	host, _ := os.Hostname()
-	nc, err := nats.Connect(nats.DefaultURL)
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		panic(err)
+	}
+
+	trusted, err := cfg.trustedKeys()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(trusted) == 0 {
+		log.Println("WARN: no trusted_keys in", configFile, "all deploys will be refused")
+	}
+
+	pub, priv, err := loadOrCreateKey(cfg.KeyFile)
+	if err != nil {
+		panic(err)
+	}
+
+	nc, err := nats.Connect(cfg.NatsURL)
 	if err != nil {
 		panic(err)
 	}
 
 	// listen for pings
-	sub1, err := nc.Subscribe("nansible.ping", func(msg *nats.Msg) { nc.Publish("nansible.pong", []byte(host)) })
+	pong := nansibled.NansibleMessage{Host: host, PublicKey: nansibled.EncodeKey(pub), Labels: cfg.Labels}
+	sub1, err := nc.Subscribe("nansible.ping", func(msg *nats.Msg) { nc.Publish("nansible.pong", pong.Bytes()) })
 	if err != nil {
 		panic(err)
 	}
@@ -34,71 +56,278 @@ func main() {
 	}
 	defer sub2.Unsubscribe()
 
-	dp := deployer{}
+	dp := &deployer{grace: cfg.CancelGrace}
+	st := stager{dir: cfg.StateDir, keep: cfg.KeepDeploys}
+	nonces := loadNonces(cfg.NonceFile, cfg.MaxNonces, cfg.ClockSkew)
+	cached := &cache{dir: filepath.Join(cfg.StateDir, "cache"), max: cfg.CacheSize}
+	ftch := fetcher{nc: nc, host: host, dir: filepath.Join(cfg.StateDir, "artifacts"), timeout: cfg.ChunkTimeout, retryFor: cfg.FetchRetry}
+
+	// refuse replies to the request with the reason it won't be done, asking for
+	// the playbook if it was only offered by its hash and isn't cached
+	refuse := func(msg *nats.Msg, in nansibled.NansibleMessage, err error) {
+		res := nansibled.NansibleMessage{Host: host, Deploy: in.Deploy, Error: err.Error()}
+		res.Missing = errors.Is(err, errNotCached)
+		nc.Publish(msg.Reply, res.Bytes())
+	}
+
+	// unseal decrypts the playbook and the vars that come with it, the playbook is
+	// taken from the cache when the server only sent its hash, and is fetched first
+	// if it was too big to be sent in the message
+	unseal := func(in nansibled.NansibleMessage) (string, []byte, error) {
+		data, err := playbookData(in, cached, ftch, pub, priv)
+		if err != nil || in.Vars == "" {
+			return string(data), nil, err
+		}
+
+		vars, err := nansibled.OpenPayload(in.Vars, pub, priv)
+		return string(data), vars, err
+	}
+
+	// parse makes sure the message came from the server and isn't being replayed
+	parse := func(msg *nats.Msg) (nansibled.NansibleMessage, error) {
+		in, err := nansibled.ParseSigned(msg.Data, trusted)
+		if err != nil {
+			return in, err
+		}
+
+		if err := in.CheckFresh(cfg.ClockSkew); err != nil {
+			return in, err
+		}
+
+		return in, nonces.check(in)
+	}
+
+	// listen for cancellations
+	sub3, err := nc.Subscribe("nansible."+host+".cancel", func(msg *nats.Msg) {
+		in, err := parse(msg)
+		if err != nil {
+			refuse(msg, in, err)
+			return
+		}
+
+		if err := dp.Cancel(in.Deploy); err != nil {
+			refuse(msg, in, err)
+			return
+		}
+
+		nc.Publish(msg.Reply, nansibled.NansibleMessage{Host: host, Deploy: in.Deploy}.Bytes())
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer sub3.Unsubscribe()
+
+	// listen for drift checks
+	sub4, err := nc.Subscribe("nansible."+host+".check", func(msg *nats.Msg) {
+		in, err := parse(msg)
+		if err != nil {
+			refuse(msg, in, err)
+			return
+		}
+
+		pb, vars, err := unseal(in)
+		if err != nil {
+			refuse(msg, in, err)
+			return
+		}
+
+		dir, err := st.stageCheck(in.Deploy, in.Entrypoint, pb, vars)
+		if err != nil {
+			refuse(msg, in, err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		out, results, err := dp.Check(in.Deploy, dir)
+		res := nansibled.NansibleMessage{Host: host, Deploy: in.Deploy, Payload: string(out), Result: results}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		res.Redact(secretValues(vars))
+
+		nc.Publish(msg.Reply, res.Bytes())
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer sub4.Unsubscribe()
+
+	// listen for requests for facts, proving them with the challenge the server
+	// sealed to our key, and let the server know to ask for them on connect
+	sub5, err := nc.Subscribe("nansible."+host+".facts", func(msg *nats.Msg) {
+		in, err := parse(msg)
+		if err != nil {
+			refuse(msg, in, err)
+			return
+		}
+
+		challenge, err := nansibled.OpenPayload(in.Payload, pub, priv)
+		if err != nil {
+			refuse(msg, in, err)
+			return
+		}
+
+		data, err := json.Marshal(gatherFacts(host))
+		if err != nil {
+			refuse(msg, in, err)
+			return
+		}
+
+		res := nansibled.NansibleMessage{Host: host, Payload: string(data), Proof: nansibled.Prove(challenge, data)}
+		nc.Publish(msg.Reply, res.Bytes())
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer sub5.Unsubscribe()
+
+	nc.Publish("nansible.facts", nansibled.NansibleMessage{Host: host}.Bytes())
 
 	for msg := range msgs {
-		in, err := nansibled.ParseNanMsg(msg.Data)
+		in, err := parse(msg)
 		if err != nil {
-			nc.Publish(msg.Reply, nil)
+			refuse(msg, in, err)
 			continue
 		}
 
-		pb := decryptPlaybook([]byte(in.Playbook))
-		sum := md5PB(pb)
+		pb, vars, err := unseal(in)
+		if err != nil {
+			refuse(msg, in, err)
+			continue
+		}
+
+		sum := md5PB(pb, in.Entrypoint)
+
+		dir, err := st.stage(in.Deploy, in.Entrypoint, pb, vars)
+		switch {
+		case errors.Is(err, errAlreadyStaged):
+			// the server missed the ack, so ack again without running it twice
+			nc.Publish(msg.Reply, nansibled.NansibleMessage{Host: host, Deploy: in.Deploy, Payload: sum}.Bytes())
+			continue
+		case err != nil:
+			refuse(msg, in, err)
+			continue
+		}
 
 		// ack
-		nc.Publish(msg.Reply, []byte(sum))
+		nc.Publish(msg.Reply, nansibled.NansibleMessage{Host: host, Deploy: in.Deploy, Payload: sum}.Bytes())
+
+		if err := st.activate(dir); err != nil {
+			log.Println("ERROR: failed to activate deploy:", err)
+		}
+
+		// stream the output as it happens, without any secrets that were used
+		var seq int64
+		secrets := secretValues(vars)
+		onLine := func(line string) {
+			seq++
+			line = nansibled.Redact(line, secrets)
+			nc.Publish("nansible."+host+".deploy."+in.Deploy+".log", nansibled.NansibleMessage{Host: host, Deploy: in.Deploy, Seq: seq, Payload: line}.Bytes())
+		}
 
 		// do deploy
-		out, err := dp.Deploy(pb)
+		out, results, err := dp.Deploy(in.Deploy, dir, onLine)
 
-		// nsg := nansibled.NansibleMessage{
-		// 	Host: host,
-		// }
+		res := nansibled.NansibleMessage{
+			Host:    host,
+			Deploy:  in.Deploy,
+			Payload: string(out),
+			Result:  results,
+		}
 
-		// ack success or error
-		if err != nil {
-			nc.Publish("nansible."+host+".playbook.error", out)
+		result := "success"
+		switch {
+		case err == nil:
+			if err := st.markGood(dir); err != nil {
+				log.Println("ERROR: failed to mark deploy as good:", err)
+			}
+		case errors.Is(err, errCancelled):
+			res.Error = err.Error()
+			result = "cancelled"
+		case in.RollbackOnFailure || cfg.RollbackOnFailure:
+			res.Error = err.Error()
+			result = "error"
+			// a failed rollback leaves the host in an unknown state, so it is still
+			// an error but with the rollback failure attached
+			if res.Rollback = rollback(st, dp, in.Deploy, onLine); res.Rollback != nil && res.Rollback.Error == "" {
+				result = "rolled_back"
+			}
+		default:
+			res.Error = err.Error()
+			result = "error"
 		}
+		st.prune()
+		res.Redact(secrets)
 
-		nc.Publish("nansible."+host+".playbook.success", out)
+		// ack success or error
+		nc.Publish("nansible."+host+".playbook."+result, res.Bytes())
 	}
 }
 
-type deployer struct {
-	mu   *sync.Mutex
-	curr *os.Process
-}
+// secretValues returns the values of the secrets in the vars, so they can be
+// kept out of the output
+func secretValues(vars []byte) []string {
+	var v struct {
+		Secrets map[string]interface{} `json:"secrets"`
+	}
+	json.Unmarshal(vars, &v)
 
-func (dp deployer) Cancel() {
-	if dp.curr == nil {
-		return
+	values := []string{}
+	for _, s := range v.Secrets {
+		if s, ok := s.(string); ok {
+			values = append(values, s)
+		}
 	}
-	dp.curr.Signal(syscall.SIGTERM)
-	dp.curr.Wait()
+	return values
 }
 
-func (dp deployer) Deploy(yml string) ([]byte, error) {
-	dp.mu.Lock()
-	defer dp.mu.Unlock()
+// md5PB is the checksum of the playbook that the server expects in the ack
+func md5PB(in, entrypoint string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(in+entrypoint)))
+}
 
-	cmd := exec.Command("ansible-playbook", "/etc/nansible/current", "-i", "127.0.0.1,")
+// playbookData returns the decrypted playbook from the message, or from the cache
+// when the message only has its hash, or fetched when the message refers to it
+func playbookData(in nansibled.NansibleMessage, cached *cache, ftch fetcher, pub, priv *[32]byte) ([]byte, error) {
+	if in.Payload == "" && in.Artifact == "" {
+		if in.Checksum == "" {
+			return nil, errors.New("no playbook in message")
+		}
+		return cached.get(in.Checksum)
+	}
 
-	buf := bytes.NewBufferString("")
-	cmd.Stdout = buf
-	cmd.Stderr = buf
+	data, err := nansibled.OpenPayload(in.Payload, pub, priv)
+	if err != nil {
+		return nil, err
+	}
 
-	err := cmd.Start()
-	dp.curr = cmd.Process
+	// for an artifact the payload is only the key to open it with
+	if in.Artifact != "" {
+		sealed, err := ftch.fetch(in.Artifact, in.Size)
+		if err != nil {
+			return nil, err
+		}
 
-	err = cmd.Wait()
-	return buf.Bytes(), err
-}
+		if data, err = nansibled.OpenArtifact(sealed, data); err != nil {
+			return nil, err
+		}
 
-func md5PB(in string) string {
-	return ""
-}
+		if nansibled.Checksum(data) != in.Artifact {
+			return nil, errors.New("artifact does not match its hash")
+		}
+	}
+
+	if in.Checksum == "" {
+		return data, nil
+	}
+
+	if nansibled.Checksum(data) != in.Checksum {
+		return nil, errors.New("playbook does not match its checksum")
+	}
+
+	if err := cached.put(in.Checksum, data); err != nil {
+		log.Println("ERROR: failed to cache playbook:", err)
+	}
 
-func decryptPlaybook(data []byte) string {
-	return string(data)
+	return data, nil
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+)
+
+// nonceStore remembers the nonces of received messages until they expire so that
+// replayed messages can be refused, it is saved to disk to survive restarts
+type nonceStore struct {
+	mu   sync.Mutex
+	fn   string
+	max  int
+	skew time.Duration
+	seen map[string]int64 // nonce to expiry
+}
+
+func loadNonces(fn string, max int, skew time.Duration) *nonceStore {
+	ns := &nonceStore{fn: fn, max: max, skew: skew, seen: map[string]int64{}}
+
+	data, err := os.ReadFile(fn)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Println("ERROR: failed to read nonces:", err)
+	default:
+		if err := json.Unmarshal(data, &ns.seen); err != nil {
+			log.Println("ERROR: failed to read nonces:", err)
+		}
+	}
+
+	return ns
+}
+
+// check returns an error if the message nonce has been seen before, otherwise it
+// remembers it
+func (ns *nonceStore) check(nsg nansibled.NansibleMessage) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	// forget nonces for messages that would be refused as expired anyway
+	cutoff := time.Now().Add(-ns.skew).Unix()
+	for n, exp := range ns.seen {
+		if exp < cutoff {
+			delete(ns.seen, n)
+		}
+	}
+
+	if _, found := ns.seen[nsg.Nonce]; found {
+		return nansibled.ErrReplayed
+	}
+
+	// drop the soonest to expire when full
+	for len(ns.seen) > 0 && len(ns.seen) >= ns.max {
+		var oldest string
+		for n, exp := range ns.seen {
+			if oldest == "" || exp < ns.seen[oldest] {
+				oldest = n
+			}
+		}
+		delete(ns.seen, oldest)
+	}
+
+	ns.seen[nsg.Nonce] = nsg.ExpiresAt
+	ns.save()
+	return nil
+}
+
+func (ns *nonceStore) save() {
+	data, _ := json.Marshal(ns.seen)
+	if err := os.MkdirAll(filepath.Dir(ns.fn), 0700); err != nil {
+		log.Println("ERROR: failed to save nonces:", err)
+		return
+	}
+
+	tmp := ns.fn + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Println("ERROR: failed to save nonces:", err)
+		return
+	}
+
+	if err := os.Rename(tmp, ns.fn); err != nil {
+		log.Println("ERROR: failed to save nonces:", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+)
+
+func stamped(ttl time.Duration) nansibled.NansibleMessage {
+	nsg := nansibled.NansibleMessage{Host: "web1"}
+	nsg.Stamp(ttl)
+	return nsg
+}
+
+func TestNonceStore(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "state", "nonces.json")
+	ns := loadNonces(fn, 10, time.Minute)
+
+	nsg := stamped(time.Minute)
+	if err := ns.check(nsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ns.check(nsg); err != nansibled.ErrReplayed {
+		t.Errorf("replayed message got %v, want ErrReplayed", err)
+	}
+
+	// the nonces are remembered across restarts
+	if err := loadNonces(fn, 10, time.Minute).check(nsg); err != nansibled.ErrReplayed {
+		t.Errorf("replayed message after a restart got %v, want ErrReplayed", err)
+	}
+
+	if err := ns.check(stamped(time.Minute)); err != nil {
+		t.Errorf("new message refused: %v", err)
+	}
+}
+
+func TestNonceStoreForgetsExpired(t *testing.T) {
+	ns := loadNonces(filepath.Join(t.TempDir(), "nonces.json"), 10, time.Minute)
+
+	expired := stamped(time.Minute)
+	expired.ExpiresAt = time.Now().Add(-2 * time.Minute).Unix()
+	ns.seen[expired.Nonce] = expired.ExpiresAt
+
+	if err := ns.check(stamped(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := ns.seen[expired.Nonce]; found {
+		t.Error("expired nonce was not forgotten")
+	}
+}
+
+func TestNonceStoreMax(t *testing.T) {
+	for _, max := range []int{-1, 0, 1, 3} {
+		ns := loadNonces(filepath.Join(t.TempDir(), "nonces.json"), max, time.Minute)
+
+		var first nansibled.NansibleMessage
+		for i := 0; i < 5; i++ {
+			nsg := stamped(time.Duration(i+1) * time.Minute)
+			if i == 0 {
+				first = nsg
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- ns.check(nsg) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("max %d: %v", max, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("max %d: check never returned", max)
+			}
+		}
+
+		want := max
+		if want < 1 {
+			want = 1
+		}
+		if len(ns.seen) != want {
+			t.Errorf("max %d: remembered %d nonces, want %d", max, len(ns.seen), want)
+		}
+
+		// the soonest to expire is dropped first
+		if _, found := ns.seen[first.Nonce]; found && max < 5 {
+			t.Errorf("max %d: the soonest to expire nonce was kept", max)
+		}
+	}
+}
+
+func TestLoadConfigMaxNonces(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "nansible.yml")
+	for _, tt := range []struct {
+		yml string
+		ok  bool
+	}{
+		{"max_nonces: 100\n", true},
+		{"clock_skew: 30s\n", true},
+		{"max_nonces: 0\n", false},
+		{"max_nonces: -5\n", false},
+	} {
+		if err := os.WriteFile(fn, []byte(tt.yml), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := loadConfig(fn); (err == nil) != tt.ok {
+			t.Errorf("loadConfig(%q) error = %v, want ok %v", tt.yml, err, tt.ok)
+		}
+	}
+}
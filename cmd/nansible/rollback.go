@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+)
+
+// rollback reapplies the last playbook that deployed successfully, returning nil
+// if there isn't one to reapply
+func rollback(st stager, dp *deployer, id string, onLine func(string)) *nansibled.NansibleMessage {
+	good, err := os.Readlink(st.lastGood())
+	if err != nil {
+		log.Println("nothing to roll back to:", err)
+		return nil
+	}
+
+	if err := st.activate(good); err != nil {
+		log.Println("ERROR: failed to activate last good deploy:", err)
+	}
+
+	onLine("rolling back to " + filepath.Base(good))
+	out, results, err := dp.Deploy(id, good, onLine)
+	res := &nansibled.NansibleMessage{Deploy: filepath.Base(good), Payload: string(out), Result: results}
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	return res
+}
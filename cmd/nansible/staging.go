@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	playbookFile   = "playbook.yml"
+	varsFile       = "vars.json"
+	bundleDir      = "bundle"
+	entrypointFile = "entrypoint"
+	checksumFile   = "checksum"
+)
+
+// errAlreadyStaged is returned when the same playbook was already staged for the
+// deploy, which happens when the server resends a deploy it didn't see the ack for
+var errAlreadyStaged = errors.New("deploy is already staged")
+
+// stager keeps each deploy in its own directory under the state dir, with the
+// current symlink pointing at the one that was last activated
+type stager struct {
+	dir  string
+	keep int
+}
+
+func (st stager) deploysDir() string { return filepath.Join(st.dir, "deploys") }
+func (st stager) checksDir() string  { return filepath.Join(st.dir, "checks") }
+func (st stager) current() string    { return filepath.Join(st.dir, "current") }
+func (st stager) lastGood() string   { return filepath.Join(st.dir, "last-good") }
+
+// stage writes the playbook and its vars into a new directory for the deploy and
+// validates them, when there is an entrypoint the playbook is a bundle that is
+// extracted into the directory instead
+func (st stager) stage(id, entrypoint, pb string, vars []byte) (string, error) {
+	return stageIn(st.deploysDir(), id, entrypoint, pb, vars)
+}
+
+// stageCheck writes the playbook into a directory for a drift check, which isn't
+// kept as one of the deploys and should be removed once the check is done
+func (st stager) stageCheck(id, entrypoint, pb string, vars []byte) (string, error) {
+	return stageIn(st.checksDir(), id, entrypoint, pb, vars)
+}
+
+func stageIn(parent, id, entrypoint, pb string, vars []byte) (string, error) {
+	if id == "" || id != filepath.Base(id) || id == "." || id == ".." {
+		return "", errors.New("invalid deploy id")
+	}
+
+	dir := filepath.Join(parent, id)
+	sum := md5PB(pb, entrypoint)
+	if staged, err := os.ReadFile(filepath.Join(dir, checksumFile)); err == nil {
+		if string(staged) != sum {
+			return "", errors.New("deploy was already staged with a different playbook")
+		}
+		return dir, errAlreadyStaged
+	}
+
+	if entrypoint != "" {
+		var err error
+		if entrypoint, err = nansibled.BundlePath(entrypoint); err != nil {
+			return "", errors.New("invalid entrypoint")
+		}
+	} else if err := checkPlaybook([]byte(pb)); err != nil {
+		return "", err
+	}
+
+	if len(vars) > 0 {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(vars, &obj); err != nil {
+			return "", errors.New("invalid vars: " + err.Error())
+		}
+	}
+
+	if err := os.MkdirAll(parent, 0700); err != nil {
+		return "", err
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", err
+	}
+
+	if entrypoint != "" {
+		if err := stageBundle(dir, entrypoint, []byte(pb)); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	} else if err := os.WriteFile(filepath.Join(dir, playbookFile), []byte(pb), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	if len(vars) > 0 {
+		if err := os.WriteFile(filepath.Join(dir, varsFile), vars, 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+
+	// written last so that only a completely staged deploy is seen as a duplicate
+	if err := os.WriteFile(filepath.Join(dir, checksumFile), []byte(sum), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
+}
+
+func checkPlaybook(yml []byte) error {
+	var plays []interface{}
+	if err := yaml.Unmarshal(yml, &plays); err != nil {
+		return errors.New("invalid playbook: " + err.Error())
+	}
+
+	if len(plays) == 0 {
+		return errors.New("playbook has no plays")
+	}
+
+	return nil
+}
+
+// stageBundle extracts the bundle into the deploy directory and records which
+// playbook in it should be run
+func stageBundle(dir, entrypoint string, data []byte) error {
+	root := filepath.Join(dir, bundleDir)
+	if err := os.Mkdir(root, 0700); err != nil {
+		return err
+	}
+
+	err := nansibled.WalkBundle(data, func(name string, mode os.FileMode, r io.Reader) error {
+		fn := filepath.Join(root, filepath.FromSlash(name))
+		if !strings.HasPrefix(fn, root+string(filepath.Separator)) {
+			return nansibled.ErrBundleBadPath
+		}
+
+		// keep the executable bits so scripts in files/ and library/ still run,
+		// but never make anything writable by others
+		perm := mode.Perm()&0755 | 0600
+		if mode.IsDir() {
+			if err := os.MkdirAll(fn, 0700); err != nil {
+				return err
+			}
+			return os.Chmod(fn, perm|0700)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+	if err != nil {
+		return err
+	}
+
+	yml, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(entrypoint)))
+	if err != nil {
+		return errors.New("entrypoint " + entrypoint + " not found in bundle")
+	}
+
+	if err := checkPlaybook(yml); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, entrypointFile), []byte(entrypoint), 0600)
+}
+
+// playbookPath returns the playbook to run in the staged directory and the
+// directory to run it from, which is inside the bundle if there is one
+func playbookPath(dir string) (string, string) {
+	entrypoint, err := os.ReadFile(filepath.Join(dir, entrypointFile))
+	if err != nil {
+		return filepath.Join(dir, playbookFile), dir
+	}
+
+	root := filepath.Join(dir, bundleDir)
+	return filepath.Join(root, filepath.FromSlash(string(entrypoint))), root
+}
+
+// activate atomically points the current symlink at the staged directory
+func (st stager) activate(dir string) error {
+	return swapLink(st.current(), dir)
+}
+
+// markGood records the staged directory as the last one that deployed successfully
+func (st stager) markGood(dir string) error {
+	return swapLink(st.lastGood(), dir)
+}
+
+func swapLink(link, dir string) error {
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(dir, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// prune removes all but the newest deploy directories, never removing the current
+// or last good ones
+func (st stager) prune() {
+	entries, err := os.ReadDir(st.deploysDir())
+	if err != nil {
+		log.Println("ERROR: failed to prune deploys:", err)
+		return
+	}
+
+	type staged struct {
+		path string
+		mod  int64
+	}
+
+	var dirs []staged
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		dirs = append(dirs, staged{filepath.Join(st.deploysDir(), e.Name()), info.ModTime().UnixNano()})
+	}
+
+	if len(dirs) <= st.keep {
+		return
+	}
+
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].mod > dirs[j].mod })
+
+	curr, _ := os.Readlink(st.current())
+	good, _ := os.Readlink(st.lastGood())
+	for _, d := range dirs[st.keep:] {
+		if d.path == curr || d.path == good {
+			continue
+		}
+
+		if err := os.RemoveAll(d.path); err != nil {
+			log.Println("ERROR: failed to prune deploy:", err)
+		}
+	}
+}
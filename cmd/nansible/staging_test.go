@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPlaybook = "- hosts: all\n  tasks: []\n"
+
+func TestStage(t *testing.T) {
+	st := stager{dir: t.TempDir(), keep: 5}
+
+	dir, err := st.stage("d1", "", testPlaybook, []byte(`{"port": 80}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dir != filepath.Join(st.deploysDir(), "d1") {
+		t.Errorf("staged in %s", dir)
+	}
+
+	for fn, want := range map[string]string{playbookFile: testPlaybook, varsFile: `{"port": 80}`, checksumFile: md5PB(testPlaybook, "")} {
+		data, err := os.ReadFile(filepath.Join(dir, fn))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", fn, data, err, want)
+		}
+	}
+
+	if pb, wd := playbookPath(dir); pb != filepath.Join(dir, playbookFile) || wd != dir {
+		t.Errorf("playbookPath = %s, %s", pb, wd)
+	}
+
+	// a resent deploy is recognised rather than staged again
+	if again, err := st.stage("d1", "", testPlaybook, nil); err != errAlreadyStaged || again != dir {
+		t.Errorf("staging again = %s, %v, want errAlreadyStaged", again, err)
+	}
+
+	if _, err := st.stage("d1", "", "- hosts: web\n", nil); err == nil || err == errAlreadyStaged {
+		t.Errorf("staging a different playbook with the same id = %v, want an error", err)
+	}
+}
+
+func TestStageInvalid(t *testing.T) {
+	tests := []struct {
+		desc string
+		id   string
+		pb   string
+		vars string
+	}{
+		{"no id", "", testPlaybook, ""},
+		{"parent id", "..", testPlaybook, ""},
+		{"dot id", ".", testPlaybook, ""},
+		{"path id", "../../etc", testPlaybook, ""},
+		{"nested id", "a/b", testPlaybook, ""},
+		{"not yaml", "d1", "- hosts: [", ""},
+		{"no plays", "d1", "", ""},
+		{"not a list", "d1", "hosts: all", ""},
+		{"bad vars", "d1", testPlaybook, "[1, 2]"},
+	}
+
+	for _, tt := range tests {
+		st := stager{dir: t.TempDir(), keep: 5}
+		if _, err := st.stage(tt.id, "", tt.pb, []byte(tt.vars)); err == nil {
+			t.Errorf("%s: expected an error", tt.desc)
+		}
+
+		entries, _ := os.ReadDir(st.deploysDir())
+		if len(entries) != 0 {
+			t.Errorf("%s: left %d directories behind", tt.desc, len(entries))
+		}
+	}
+}
+
+func TestActivate(t *testing.T) {
+	st := stager{dir: t.TempDir(), keep: 2}
+
+	var dirs []string
+	for i, id := range []string{"d1", "d2", "d3", "d4", "d5"} {
+		dir, err := st.stage(id, "", testPlaybook, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// prune goes by age, so make sure each one is newer than the last
+		at := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(dir, at, at)
+		dirs = append(dirs, dir)
+	}
+
+	if err := st.activate(dirs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.markGood(dirs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.activate(dirs[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if curr, _ := os.Readlink(st.current()); curr != dirs[1] {
+		t.Errorf("current points at %s, want %s", curr, dirs[1])
+	}
+	if good, _ := os.Readlink(st.lastGood()); good != dirs[0] {
+		t.Errorf("last-good points at %s, want %s", good, dirs[0])
+	}
+	if _, err := os.Lstat(st.current() + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary symlink was left behind")
+	}
+
+	// the two newest are kept, along with the current and last good ones
+	st.prune()
+	for i, dir := range dirs {
+		_, err := os.Stat(dir)
+		if kept := err == nil; kept != (i != 2) {
+			t.Errorf("%s kept = %v", filepath.Base(dir), kept)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+)
+
+// requester sends a request and waits for the reply, which a NATS connection does
+type requester interface {
+	Request(subj string, data []byte, timeout time.Duration) (*nats.Msg, error)
+}
+
+// fetcher downloads payloads that were too big to send in the deploy message, in
+// chunks from the server, keeping what it has so far on disk so that the download
+// can carry on from where it was after losing the connection
+type fetcher struct {
+	nc       requester
+	host     string
+	dir      string
+	timeout  time.Duration
+	retryFor time.Duration
+}
+
+func (f fetcher) partial(hash string) string { return filepath.Join(f.dir, hash+".part") }
+
+// fetch downloads the sealed artifact with the given hash and size, the caller
+// checks the hash once it has been opened
+func (f fetcher) fetch(hash string, size int64) ([]byte, error) {
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+		return nil, errors.New("invalid artifact hash")
+	}
+
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	fn := f.partial(hash)
+	file, err := os.OpenFile(fn, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := info.Size()
+	if offset > size {
+		offset = 0
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		log.Printf("resuming download of %s from %d of %d bytes", hash, offset, size)
+	}
+
+	progressAt := time.Now()
+	for offset < size {
+		if time.Since(progressAt) > f.retryFor {
+			return nil, errors.New("gave up downloading artifact " + hash)
+		}
+
+		chunk, err := f.chunk(hash, offset)
+		switch {
+		case errors.Is(err, nansibled.ErrBadChecksum), errors.Is(err, nats.ErrTimeout), errors.Is(err, nats.ErrNoResponders), errors.Is(err, nats.ErrConnectionReconnecting):
+			log.Println("WARN: failed to download artifact chunk, retrying:", err)
+			time.Sleep(time.Second)
+			continue
+		case err != nil:
+			return nil, err
+		case len(chunk) == 0:
+			return nil, errors.New("artifact " + hash + " ended early")
+		}
+
+		if _, err := file.WriteAt(chunk, offset); err != nil {
+			return nil, err
+		}
+
+		offset += int64(len(chunk))
+		progressAt = time.Now()
+	}
+
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(fn)
+
+	if int64(len(data)) != size {
+		return nil, errors.New("downloaded artifact " + hash + " is the wrong size")
+	}
+
+	return data, nil
+}
+
+// chunk requests the part of the artifact starting at the offset
+func (f fetcher) chunk(hash string, offset int64) ([]byte, error) {
+	req := nansibled.NansibleMessage{Host: f.host, Artifact: hash, Offset: offset}
+	msg, err := f.nc.Request("nansible."+f.host+".artifact", req.Bytes(), f.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := nansibled.ParseNanMsg(msg.Data)
+	switch {
+	case err != nil:
+		return nil, err
+	case res.Error != "":
+		return nil, errors.New(res.Error)
+	case res.Artifact != hash || res.Offset != offset:
+		return nil, errors.New("server sent the wrong chunk")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(res.Payload)
+	if err != nil || nansibled.Checksum(data) != res.Checksum {
+		return nil, nansibled.ErrBadChecksum
+	}
+
+	return data, nil
+}
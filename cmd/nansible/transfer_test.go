@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/penguinpowernz/nansible/pkg/nansibled"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// fakeArtifacts replies to chunk requests the way the server does
+type fakeArtifacts struct {
+	mu       sync.Mutex
+	data     []byte
+	chunk    int
+	offsets  []int64
+	corrupt  map[int64]int // offset to how many times to send a bad chunk
+	failFrom int64         // offset to start replying with an error from, if set
+	err      error
+}
+
+func (fa *fakeArtifacts) Request(subj string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	if fa.err != nil {
+		return nil, fa.err
+	}
+
+	req, err := nansibled.ParseNanMsg(data)
+	if err != nil || subj != "nansible."+req.Host+".artifact" {
+		return nil, errors.New("bad request")
+	}
+	fa.offsets = append(fa.offsets, req.Offset)
+
+	res := nansibled.NansibleMessage{Host: req.Host, Artifact: req.Artifact, Offset: req.Offset, Size: int64(len(fa.data))}
+	if fa.failFrom > 0 && req.Offset >= fa.failFrom {
+		res.Error = "artifact not found"
+		return &nats.Msg{Data: res.Bytes()}, nil
+	}
+
+	end := int(req.Offset) + fa.chunk
+	if end > len(fa.data) {
+		end = len(fa.data)
+	}
+	part := fa.data[req.Offset:end]
+
+	res.Payload = base64.StdEncoding.EncodeToString(part)
+	res.Checksum = nansibled.Checksum(part)
+	if fa.corrupt[req.Offset] > 0 {
+		fa.corrupt[req.Offset]--
+		res.Checksum = nansibled.Checksum([]byte("something else"))
+	}
+
+	return &nats.Msg{Data: res.Bytes()}, nil
+}
+
+func newFetcher(t *testing.T, fa *fakeArtifacts) fetcher {
+	return fetcher{nc: fa, host: "web1", dir: t.TempDir(), timeout: time.Second, retryFor: time.Minute}
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+func TestFetch(t *testing.T) {
+	data := randomBytes(1000)
+	hash := nansibled.Checksum(data)
+	fa := &fakeArtifacts{data: data, chunk: 256}
+	ftch := newFetcher(t, fa)
+
+	got, err := ftch.fetch(hash, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded artifact doesn't match")
+	}
+
+	if want := []int64{0, 256, 512, 768}; !equalOffsets(fa.offsets, want) {
+		t.Errorf("requested offsets %v, want %v", fa.offsets, want)
+	}
+
+	if _, err := os.Stat(ftch.partial(hash)); !os.IsNotExist(err) {
+		t.Error("partial download was left behind")
+	}
+}
+
+func TestFetchResumes(t *testing.T) {
+	data := randomBytes(1000)
+	hash := nansibled.Checksum(data)
+
+	// the server goes away part way through
+	fa := &fakeArtifacts{data: data, chunk: 256, failFrom: 512}
+	ftch := newFetcher(t, fa)
+	if _, err := ftch.fetch(hash, int64(len(data))); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	part, err := os.ReadFile(ftch.partial(hash))
+	if err != nil || !bytes.Equal(part, data[:512]) {
+		t.Fatalf("partial download has %d bytes, %v, want the first 512", len(part), err)
+	}
+
+	fa.failFrom = 0
+	fa.offsets = nil
+	got, err := ftch.fetch(hash, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("resumed artifact doesn't match")
+	}
+
+	if want := []int64{512, 768}; !equalOffsets(fa.offsets, want) {
+		t.Errorf("requested offsets %v, want %v", fa.offsets, want)
+	}
+}
+
+func TestFetchRestartsOversizedPart(t *testing.T) {
+	data := randomBytes(300)
+	hash := nansibled.Checksum(data)
+	fa := &fakeArtifacts{data: data, chunk: 256}
+	ftch := newFetcher(t, fa)
+
+	if err := os.WriteFile(ftch.partial(hash), randomBytes(400), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ftch.fetch(hash, int64(len(data)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("fetch = %d bytes, %v", len(got), err)
+	}
+
+	if fa.offsets[0] != 0 {
+		t.Errorf("started from %d, want 0", fa.offsets[0])
+	}
+}
+
+func TestFetchRetriesBadChunks(t *testing.T) {
+	data := randomBytes(600)
+	hash := nansibled.Checksum(data)
+	fa := &fakeArtifacts{data: data, chunk: 256, corrupt: map[int64]int{256: 1}}
+
+	got, err := newFetcher(t, fa).fetch(hash, int64(len(data)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("fetch = %d bytes, %v", len(got), err)
+	}
+
+	if want := []int64{0, 256, 256, 512}; !equalOffsets(fa.offsets, want) {
+		t.Errorf("requested offsets %v, want %v", fa.offsets, want)
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	data := randomBytes(600)
+	hash := nansibled.Checksum(data)
+
+	tests := []struct {
+		desc     string
+		hash     string
+		size     int64
+		fa       *fakeArtifacts
+		retryFor time.Duration
+		err      string
+	}{
+		{"invalid hash", "../../etc/passwd", 600, &fakeArtifacts{data: data, chunk: 256}, time.Minute, "invalid artifact hash"},
+		{"server error", hash, 600, &fakeArtifacts{data: data, chunk: 256, failFrom: 1}, time.Minute, "artifact not found"},
+		{"ends early", hash, 700, &fakeArtifacts{data: data, chunk: 256}, time.Minute, "ended early"},
+		{"no server", hash, 600, &fakeArtifacts{err: nats.ErrNoResponders}, 0, "gave up"},
+	}
+
+	for _, tt := range tests {
+		ftch := newFetcher(t, tt.fa)
+		ftch.retryFor = tt.retryFor
+		if _, err := ftch.fetch(tt.hash, tt.size); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.desc, err, tt.err)
+		}
+	}
+}
+
+func TestPlaybookDataFromArtifact(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	plain := []byte("- hosts: all\n  tasks: []\n")
+
+	seal := func(data []byte) ([]byte, *[32]byte) {
+		key, nonce := new([32]byte), new([24]byte)
+		rand.Read(key[:])
+		rand.Read(nonce[:])
+		return secretbox.Seal(nonce[:], data, nonce, key), key
+	}
+
+	tests := []struct {
+		desc     string
+		content  []byte
+		artifact string
+		ok       bool
+	}{
+		{"matches", plain, nansibled.Checksum(plain), true},
+		{"other content", []byte("- hosts: evil\n"), nansibled.Checksum(plain), false},
+	}
+
+	for _, tt := range tests {
+		sealed, key := seal(tt.content)
+		fa := &fakeArtifacts{data: sealed, chunk: 16}
+
+		payload, err := nansibled.SealPayload(nansibled.EncodeKey(pub), key[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		in := nansibled.NansibleMessage{Payload: payload, Artifact: tt.artifact, Size: int64(len(sealed)), Checksum: tt.artifact}
+		cached := &cache{dir: t.TempDir(), max: 1 << 20}
+		got, err := playbookData(in, cached, newFetcher(t, fa), pub, priv)
+
+		switch {
+		case tt.ok && (err != nil || !bytes.Equal(got, plain)):
+			t.Errorf("%s: playbookData = %q, %v", tt.desc, got, err)
+		case !tt.ok && err == nil:
+			t.Errorf("%s: expected an error", tt.desc)
+		}
+
+		// only content that matches is cached
+		if _, err := cached.get(tt.artifact); (err == nil) != tt.ok {
+			t.Errorf("%s: cached = %v, want %v", tt.desc, err == nil, tt.ok)
+		}
+	}
+}
+
+func equalOffsets(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"flag"
+	"log"
 	"os"
+	"time"
 
 	"github.com/albrow/zoom"
 	"github.com/gin-gonic/gin"
@@ -11,12 +13,28 @@ import (
 )
 
 func main() {
-	var createKey, redisURL, natsURL string
+	var createKey, redisURL, natsURL, signingKey, secretsKey string
+	var rotateSigningKey, showSigningKey bool
+	var signingGrace, driftInterval time.Duration
 	flag.StringVar(&createKey, "create-key", "", "create a new key to access the API with")
 	flag.StringVar(&redisURL, "r", os.Getenv("REDIS_URL"), "the redis URL to use")
 	flag.StringVar(&natsURL, "n", os.Getenv("NATS_URL"), "the NATS URL to use")
+	flag.StringVar(&signingKey, "k", os.Getenv("SIGNING_KEY"), "the file holding the key that messages to agents are signed with")
+	flag.StringVar(&secretsKey, "s", os.Getenv("SECRETS_KEY"), "the file holding the master key that secrets are encrypted with")
+	flag.BoolVar(&rotateSigningKey, "rotate-signing-key", false, "generate a new signing key, keeping the old one for the grace period")
+	flag.BoolVar(&showSigningKey, "show-signing-key", false, "show the public keys that agents should trust")
+	flag.DurationVar(&signingGrace, "signing-grace", 7*24*time.Hour, "how long to keep signing with the old key after rotating")
+	flag.DurationVar(&driftInterval, "drift-interval", 6*time.Hour, "how often to check hosts for drift, 0 to disable")
 	flag.Parse()
 
+	if signingKey == "" {
+		signingKey = "signing.key"
+	}
+
+	if secretsKey == "" {
+		secretsKey = "secrets.key"
+	}
+
 	if natsURL == "" {
 		natsURL = nats.DefaultURL
 	}
@@ -25,6 +43,15 @@ func main() {
 		redisURL = "127.0.0.1:6379"
 	}
 
+	switch {
+	case rotateSigningKey:
+		nansibled.RotateSigningKey(signingKey, signingGrace)
+		return
+	case showSigningKey:
+		nansibled.ShowSigningKeys(signingKey, signingGrace)
+		return
+	}
+
 	nc, err := nats.Connect(natsURL)
 	if err != nil {
 		panic(err)
@@ -40,6 +67,16 @@ func main() {
 		return
 	}
 
+	if err := svr.LoadSigningKey(signingKey, signingGrace); err != nil {
+		log.Fatal("failed to load signing key: ", err)
+	}
+
+	if err := svr.LoadSecretsKey(secretsKey); err != nil {
+		log.Fatal("failed to load secrets key: ", err)
+	}
+
+	svr.Start(driftInterval)
+
 	api := gin.Default()
 	svr.SetupRoutes(api)
 
@@ -5,13 +5,16 @@ go 1.18
 require (
 	github.com/Jeffail/gabs v1.4.0
 	github.com/albrow/zoom v0.19.1
+	github.com/garyburd/redigo v1.6.3
 	github.com/gin-gonic/gin v1.7.7
 	github.com/nats-io/nats.go v1.15.0
+	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/crypto v0.0.0-20220315160706-3147a52a75dd
+	gopkg.in/yaml.v2 v2.2.8
 )
 
 require (
 	github.com/dchest/uniuri v0.0.0-20200228104902-7aecb25e1fe5 // indirect
-	github.com/garyburd/redigo v1.6.3 // indirect
 	github.com/gin-contrib/sse v0.1.0 // indirect
 	github.com/go-playground/locales v0.13.0 // indirect
 	github.com/go-playground/universal-translator v0.17.0 // indirect
@@ -27,8 +30,6 @@ require (
 	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/tv42/base58 v1.0.0 // indirect
 	github.com/ugorji/go/codec v1.1.7 // indirect
-	golang.org/x/crypto v0.0.0-20220315160706-3147a52a75dd // indirect
 	golang.org/x/sys v0.0.0-20220111092808-5a964db01320 // indirect
 	google.golang.org/protobuf v1.28.0 // indirect
-	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -0,0 +1,181 @@
+package nansibled
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	ErrBundleTooBig   = errors.New("bundle is too big")
+	ErrBundleBadPath  = errors.New("bundle contains a path outside of the bundle")
+	ErrBundleBadEntry = errors.New("bundle contains an entry that isn't a file or directory")
+
+	MaxBundleSize  int64 = 64 << 20
+	MaxBundleFiles       = 10000
+)
+
+// IsBundle returns true if the data looks like a gzipped tar
+func IsBundle(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// BundlePath cleans the path of an entry in a bundle, returning an error if it is
+// absolute or would end up outside of the directory it is extracted to
+func BundlePath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") {
+		return "", ErrBundleBadPath
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", ErrBundleBadPath
+		}
+	}
+
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", ErrBundleBadPath
+	}
+	return clean, nil
+}
+
+// WalkBundle calls fn with each file and directory in the gzipped tar, checking
+// the paths, entry types and sizes before fn sees them, the mode is the entry's
+// permissions along with whether it is a directory
+func WalkBundle(data []byte, fn func(name string, mode os.FileMode, r io.Reader) error) error {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return errors.New("invalid bundle: " + err.Error())
+	}
+	defer zr.Close()
+
+	var total int64
+	var count int
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return errors.New("invalid bundle: " + err.Error())
+		}
+
+		count++
+		total += hdr.Size
+		if count > MaxBundleFiles || total > MaxBundleSize {
+			return ErrBundleTooBig
+		}
+
+		name, err := BundlePath(hdr.Name)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = fn(name, os.ModeDir|os.FileMode(hdr.Mode).Perm(), nil)
+		case tar.TypeReg, tar.TypeRegA:
+			err = fn(name, os.FileMode(hdr.Mode).Perm(), io.LimitReader(tr, hdr.Size))
+		case tar.TypeXGlobalHeader, tar.TypeXHeader:
+			continue
+		default:
+			return fmt.Errorf("%w: %s", ErrBundleBadEntry, hdr.Name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isTemplateSource returns true if the file in the bundle is one that ansible
+// templates, which are the ones that can use secrets
+func isTemplateSource(name string) bool {
+	switch path.Ext(name) {
+	case ".yml", ".yaml", ".j2":
+		return true
+	}
+
+	for _, dir := range strings.Split(path.Dir(name), "/") {
+		if dir == "group_vars" || dir == "host_vars" {
+			return true
+		}
+	}
+	return false
+}
+
+// readBundle checks the bundle and returns the contents of the entrypoint, along
+// with the text of its yaml and jinja files
+func readBundle(data []byte, entrypoint string) (string, string, error) {
+	entrypoint, err := BundlePath(entrypoint)
+	if err != nil {
+		return "", "", errors.New("invalid entrypoint")
+	}
+
+	var yml string
+	found := false
+	text := bytes.NewBufferString("")
+	err = WalkBundle(data, func(name string, mode os.FileMode, r io.Reader) error {
+		if mode.IsDir() || (name != entrypoint && !isTemplateSource(name)) {
+			return nil
+		}
+
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if name == entrypoint {
+			yml = string(buf)
+			found = true
+		}
+
+		text.Write(buf)
+		text.WriteString("\n")
+		return nil
+	})
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if !found {
+		return "", "", errors.New("entrypoint " + entrypoint + " not found in bundle")
+	}
+
+	return yml, text.String(), nil
+}
+
+func bundleKey(hash string) string { return "nansible:bundle:" + hash }
+
+// saveBundle stores the bundle by its hash, bundles that are already stored are
+// left as they are
+func (db *db) saveBundle(hash string, data []byte) error {
+	conn := db.pool.NewConn()
+	defer conn.Close()
+
+	_, err := conn.Do("SETNX", bundleKey(hash), data)
+	return err
+}
+
+func (db *db) loadBundle(hash string) ([]byte, error) {
+	conn := db.pool.NewConn()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", bundleKey(hash)))
+	if err == redis.ErrNil {
+		return nil, errors.New("bundle " + hash + " not found")
+	}
+	return data, err
+}
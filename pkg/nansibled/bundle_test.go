@@ -0,0 +1,161 @@
+package nansibled
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name string
+	typ  byte
+	mode int64
+	body string
+}
+
+func makeBundle(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Mode: e.mode, Size: int64(len(e.body))}
+		if e.typ != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if e.typ == tar.TypeSymlink {
+			hdr.Linkname = "/etc/passwd"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte(e.body))
+		}
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestBundlePath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"site.yml", "site.yml", true},
+		{"roles/web/tasks/main.yml", "roles/web/tasks/main.yml", true},
+		{"./site.yml", "site.yml", true},
+		{"roles//web/", "roles/web", true},
+		{`roles\web\tasks\main.yml`, "roles/web/tasks/main.yml", true},
+		{"", "", false},
+		{".", "", false},
+		{"/etc/passwd", "", false},
+		{"../site.yml", "", false},
+		{"roles/../../site.yml", "", false},
+		{"roles/..", "", false},
+		{`..\site.yml`, "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := BundlePath(tt.name)
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("BundlePath(%q) failed: %v", tt.name, err)
+		case !tt.ok && err == nil:
+			t.Errorf("BundlePath(%q) = %q, want an error", tt.name, got)
+		case got != tt.want:
+			t.Errorf("BundlePath(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWalkBundle(t *testing.T) {
+	tests := []struct {
+		desc    string
+		entries []tarEntry
+		err     error
+	}{
+		{"files and dirs", []tarEntry{
+			{"roles/", tar.TypeDir, 0755, ""},
+			{"roles/run.sh", tar.TypeReg, 0755, "#!/bin/sh"},
+			{"site.yml", tar.TypeReg, 0644, "- hosts: all"},
+		}, nil},
+		{"traversal", []tarEntry{{"../evil.yml", tar.TypeReg, 0644, "x"}}, ErrBundleBadPath},
+		{"absolute", []tarEntry{{"/etc/cron.d/evil", tar.TypeReg, 0644, "x"}}, ErrBundleBadPath},
+		{"symlink", []tarEntry{{"link", tar.TypeSymlink, 0777, ""}}, ErrBundleBadEntry},
+		{"device", []tarEntry{{"dev", tar.TypeChar, 0644, ""}}, ErrBundleBadEntry},
+	}
+
+	for _, tt := range tests {
+		err := WalkBundle(makeBundle(t, tt.entries...), func(name string, mode os.FileMode, r io.Reader) error {
+			return nil
+		})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.desc, err, tt.err)
+		}
+	}
+
+	if err := WalkBundle([]byte("not a bundle"), nil); err == nil {
+		t.Error("expected an error for data that isn't a gzipped tar")
+	}
+}
+
+func TestWalkBundleModes(t *testing.T) {
+	data := makeBundle(t,
+		tarEntry{"files/", tar.TypeDir, 0750, ""},
+		tarEntry{"files/run.sh", tar.TypeReg, 0755, "#!/bin/sh"},
+		tarEntry{"site.yml", tar.TypeReg, 0644, "- hosts: all"},
+	)
+
+	modes := map[string]os.FileMode{}
+	WalkBundle(data, func(name string, mode os.FileMode, r io.Reader) error {
+		modes[name] = mode
+		return nil
+	})
+
+	want := map[string]os.FileMode{"files": os.ModeDir | 0750, "files/run.sh": 0755, "site.yml": 0644}
+	for name, m := range want {
+		if modes[name] != m {
+			t.Errorf("mode of %s = %v, want %v", name, modes[name], m)
+		}
+	}
+}
+
+func TestReadBundle(t *testing.T) {
+	data := makeBundle(t,
+		tarEntry{"site.yml", tar.TypeReg, 0644, "- hosts: all\n  roles: [web]"},
+		tarEntry{"roles/web/templates/app.conf.j2", tar.TypeReg, 0644, "password={{ secrets.db }}"},
+		tarEntry{"group_vars/all", tar.TypeReg, 0644, "token: '{{ secrets.api }}'"},
+		tarEntry{"files/README", tar.TypeReg, 0644, "{{ secrets.readme }}"},
+		tarEntry{"files/app.bin", tar.TypeReg, 0644, "\x00\x01{{ secrets.binary }}"},
+	)
+
+	yml, text, err := readBundle(data, "site.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(yml, "- hosts: all") {
+		t.Errorf("entrypoint = %q", yml)
+	}
+
+	refs := strings.Join(secretRefs(text), ",")
+	if refs != "api,db" {
+		t.Errorf("secrets found in bundle = %q, want api,db", refs)
+	}
+
+	if _, _, err := readBundle(data, "missing.yml"); err == nil {
+		t.Error("expected an error for a missing entrypoint")
+	}
+
+	if _, _, err := readBundle(data, "../site.yml"); err == nil {
+		t.Error("expected an error for an entrypoint outside the bundle")
+	}
+}
@@ -27,7 +27,7 @@ func (svr *Server) identifyAndSave() {
 		close(msgs)
 	}()
 
-	var hosts []string
+	var pongs []NansibleMessage
 	func() {
 		deadline := time.After(2 * time.Second)
 		for {
@@ -35,12 +35,19 @@ func (svr *Server) identifyAndSave() {
 			case <-deadline:
 				return
 			case msg := <-msgs:
-				hosts = append(hosts, string(msg.Data))
+				pong, err := ParseNanMsg(msg.Data)
+				if err != nil {
+					// older agents only send their hostname
+					pong = NansibleMessage{Host: string(msg.Data)}
+				}
+				pongs = append(pongs, pong)
 			}
 		}
 	}()
 
-	for _, h := range hosts {
+	for _, pong := range pongs {
+		h := pong.Host
+		hst := host{Name: h}
 		found, err := svr.db.hosts.Exists(h)
 		if err != nil {
 			log.Println("ERROR: identifyAndSave(): ", err)
@@ -48,21 +55,80 @@ func (svr *Server) identifyAndSave() {
 		}
 
 		if found {
-			if err := svr.db.hosts.SaveFields([]string{"LastSeenAt"}, &host{Name: h, LastSeenAt: time.Now()}); err != nil {
+			if err := svr.db.hosts.FindFields(h, []string{"PublicKey", "Labels"}, &hst); err != nil {
 				log.Println("ERROR: identifyAndSave(): ", err)
+				continue
 			}
+
+			fields := []string{"LastSeenAt"}
+			hst.LastSeenAt = time.Now()
+
+			// trust the first key we see, changing it has to be done through the API
+			switch {
+			case hst.PublicKey == "" && pong.PublicKey != "":
+				hst.PublicKey = pong.PublicKey
+				fields = append(fields, "PublicKey")
+			case hst.PublicKey != pong.PublicKey && pong.PublicKey != "":
+				log.Printf("WARN: host %s sent a public key that differs from the stored one, ignoring it", h)
+			}
+
+			if err := svr.db.hosts.SaveFields(fields, &hst); err != nil {
+				log.Println("ERROR: identifyAndSave(): ", err)
+			}
+
+			svr.applyAgentLabels(&hst, pong.Labels)
 			continue
 		}
 
 		// create any that don't exist
-		hst := host{
+		hst = host{
 			Name:       h,
 			State:      stateNew,
 			LastSeenAt: time.Now(),
+			PublicKey:  pong.PublicKey,
 		}
 
 		if err := svr.db.hosts.Save(&hst); err != nil {
 			log.Println("ERROR: identifyAndSave(): ", err)
+			continue
+		}
+
+		svr.applyAgentLabels(&hst, pong.Labels)
+
+		go func(h string) {
+			if _, err := svr.refreshFacts(h); err != nil {
+				log.Printf("ERROR: identifyAndSave(): failed to get facts from %s: %s", h, err)
+			}
+		}(h)
+	}
+}
+
+// applyAgentLabels sets the labels from the agent's config on the host, they
+// take precedence over the same labels set through the API
+func (svr *Server) applyAgentLabels(h *host, agent map[string]string) {
+	labels := map[string]string{}
+	for k, v := range h.Labels {
+		labels[k] = v
+	}
+
+	changed := false
+	for k, v := range agent {
+		if err := validLabel(k, v); err != nil {
+			log.Printf("WARN: host %s sent an invalid label: %s", h.Name, err)
+			continue
 		}
+
+		if labels[k] != v {
+			labels[k] = v
+			changed = true
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	if err := svr.setLabels(h, labels); err != nil {
+		log.Println("ERROR: applyAgentLabels(): ", err)
 	}
 }
@@ -0,0 +1,201 @@
+package nansibled
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// runningDeploy returns the deploy with the given ID if it is still running
+func (svr *Server) runningDeploy(id string) *deploy {
+	svr.rmu.Lock()
+	defer svr.rmu.Unlock()
+	return svr.running[id]
+}
+
+// runningDeploys returns the deploys that are still running
+func (svr *Server) runningDeploys() []*deploy {
+	svr.rmu.Lock()
+	defer svr.rmu.Unlock()
+
+	dplys := make([]*deploy, 0, len(svr.running))
+	for _, dply := range svr.running {
+		dplys = append(dplys, dply)
+	}
+	return dplys
+}
+
+// cancellation is closed when a run is cancelled, so its rollout stops starting
+// deploys and stops waiting on its canaries
+type cancellation struct {
+	done chan struct{}
+	once sync.Once
+	by   string
+	at   time.Time
+}
+
+func (cn *cancellation) cancel(user string) {
+	cn.once.Do(func() {
+		cn.by = user
+		cn.at = time.Now()
+		close(cn.done)
+	})
+}
+
+// cancelled returns true if the run was cancelled, after which by and at are set
+func (cn *cancellation) cancelled() bool {
+	select {
+	case <-cn.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackRun lets the run be cancelled while it is rolling out
+func (svr *Server) trackRun(id string) *cancellation {
+	svr.cmu.Lock()
+	defer svr.cmu.Unlock()
+
+	cn := &cancellation{done: make(chan struct{})}
+	svr.cancels[id] = cn
+	return cn
+}
+
+func (svr *Server) forgetRun(id string) {
+	svr.cmu.Lock()
+	defer svr.cmu.Unlock()
+	delete(svr.cancels, id)
+}
+
+// cancelRun cancels the run's rollout, returning false if it isn't rolling out
+func (svr *Server) cancelRun(id, user string) bool {
+	svr.cmu.Lock()
+	defer svr.cmu.Unlock()
+
+	cn, ok := svr.cancels[id]
+	if !ok {
+		return false
+	}
+
+	cn.cancel(user)
+	return true
+}
+
+// cancelDeploy asks the host to stop running the deploy
+func (svr *Server) cancelDeploy(dply *deploy, user string) error {
+	nsg := NansibleMessage{Host: dply.Host, Deploy: dply.ID}
+	nsg.Stamp(messageTTL)
+
+	msg, err := svr.nc.Request("nansible."+dply.Host+".cancel", nsg.Signed(svr.signers()...), 5*time.Second)
+	if err != nil {
+		return err
+	}
+
+	reply, err := ParseNanMsg(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+
+	dply.CancelledBy = user
+	dply.CancelledAt = time.Now()
+	return nil
+}
+
+func (svr *Server) handleCancelDeploy(c *gin.Context) {
+	id := c.Param("name")
+	user := c.GetString("user")
+
+	if dply := svr.runningDeploy(id); dply != nil {
+		if err := svr.cancelDeploy(dply, user); err != nil {
+			abortWithError(c, 502, err)
+			return
+		}
+
+		c.JSON(202, map[string]string{"id": dply.ID})
+		return
+	}
+
+	// the deploy may have been started before a restart, so the result won't be
+	// tracked and needs to be saved here
+	dply := new(deploy)
+	if err := svr.db.deploys.Find(id, dply); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if dply.State != stateAcked {
+		abortWithError(c, 409, errors.New("deploy is not running"))
+		return
+	}
+
+	if err := svr.cancelDeploy(dply, user); err != nil {
+		abortWithError(c, 502, err)
+		return
+	}
+
+	dply.State = stateCancelled
+	dply.FinishedAt = dply.CancelledAt
+	if err := svr.db.deploys.SaveFields([]string{"State", "CancelledBy", "CancelledAt", "FinishedAt"}, dply); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(202, map[string]string{"id": dply.ID})
+}
+
+func (svr *Server) handleCancelGroup(c *gin.Context) {
+	g := new(group)
+	if err := svr.db.groups.Find(c.Param("name"), g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	hosts, err := svr.groupHosts(g)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	inGroup := map[string]bool{}
+	for _, h := range hosts {
+		inGroup[h] = true
+	}
+
+	var runs []*run
+	if err := svr.db.runs.NewQuery().Filter("Group =", g.Name).Run(&runs); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	// stop the rollouts first so they don't start deploys to more hosts
+	cancelledRuns := []string{}
+	for _, r := range runs {
+		if r.FinishedAt.IsZero() && svr.cancelRun(r.ID, c.GetString("user")) {
+			cancelledRuns = append(cancelledRuns, r.ID)
+		}
+	}
+
+	errs := map[string]string{}
+	cancelled := map[string]string{}
+	for _, dply := range svr.runningDeploys() {
+		if !inGroup[dply.Host] {
+			continue
+		}
+
+		if err := svr.cancelDeploy(dply, c.GetString("user")); err != nil {
+			errs[dply.Host] = err.Error()
+			continue
+		}
+
+		cancelled[dply.Host] = dply.ID
+	}
+
+	c.JSON(202, map[string]interface{}{"errors": errs, "cancelled": cancelled, "runs": cancelledRuns})
+}
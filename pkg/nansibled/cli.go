@@ -62,6 +62,70 @@ func (svr *Server) RotateKey(name string) {
 	fmt.Printf("New token for %s is: %s\n", name, k.Token)
 }
 
+// LoadSigningKey loads the key that messages to agents are signed with, a new key
+// is generated if the file doesn't exist yet
+func (svr *Server) LoadSigningKey(fn string, grace time.Duration) error {
+	sk, err := loadSigningKeys(fn)
+	switch {
+	case os.IsNotExist(err):
+		sk = new(signingKeys)
+		if err := sk.rotate(); err != nil {
+			return err
+		}
+		sk.Previous = nil
+
+		if err := sk.save(fn); err != nil {
+			return err
+		}
+		log.Println("generated a new signing key, agents should trust the public key:", EncodePublicKey(sk.Current))
+	case err != nil:
+		return err
+	}
+
+	svr.signer = sk
+	svr.signGrace = grace
+	return nil
+}
+
+func RotateSigningKey(fn string, grace time.Duration) {
+	sk, err := loadSigningKeys(fn)
+	switch {
+	case os.IsNotExist(err):
+		sk = new(signingKeys)
+	case err != nil:
+		log.Println("ERROR:", err)
+		return
+	}
+
+	if err := sk.rotate(); err != nil {
+		log.Println("ERROR:", err)
+		return
+	}
+
+	if err := sk.save(fn); err != nil {
+		log.Println("ERROR:", err)
+		return
+	}
+
+	fmt.Printf("New signing public key is: %s\n", EncodePublicKey(sk.Current))
+	if len(sk.Previous) > 0 {
+		fmt.Printf("Old signing public key %s will still be used until %s\n", EncodePublicKey(sk.Previous), sk.RotatedAt.Add(grace).Format(time.RFC3339))
+	}
+	fmt.Println("Restart nansibled to start signing with the new key")
+}
+
+func ShowSigningKeys(fn string, grace time.Duration) {
+	sk, err := loadSigningKeys(fn)
+	if err != nil {
+		log.Println("ERROR:", err)
+		return
+	}
+
+	for _, k := range sk.active(grace) {
+		fmt.Println(EncodePublicKey(k))
+	}
+}
+
 func makeToken() string {
 	t := make([]byte, 32)
 	rand.Read(t)
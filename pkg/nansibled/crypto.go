@@ -0,0 +1,89 @@
+package nansibled
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+var (
+	ErrNoPublicKey = errors.New("host has no public key")
+	ErrInvalidKey  = errors.New("invalid key")
+	ErrCantDecrypt = errors.New("payload could not be decrypted with this host's key")
+)
+
+// ParseKey decodes a base64 encoded curve25519 key
+func ParseKey(s string) (*[32]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(data) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	k := new([32]byte)
+	copy(k[:], data)
+	return k, nil
+}
+
+// EncodeKey base64 encodes a curve25519 key
+func EncodeKey(k *[32]byte) string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// SealPayload encrypts the data so that only the holder of the private key for the
+// given public key can decrypt it
+func SealPayload(pubkey string, data []byte) (string, error) {
+	if pubkey == "" {
+		return "", ErrNoPublicKey
+	}
+
+	pk, err := ParseKey(pubkey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := box.SealAnonymous(nil, data, pk, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenPayload decrypts a payload sealed with SealPayload
+func OpenPayload(payload string, pub, priv *[32]byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrCantDecrypt
+	}
+
+	data, ok := box.OpenAnonymous(nil, sealed, pub, priv)
+	if !ok {
+		return nil, ErrCantDecrypt
+	}
+
+	return data, nil
+}
+
+// Prove returns a MAC of the data keyed with a challenge that was sealed to the
+// host, which only the holder of the host's private key could have made
+func Prove(challenge, data []byte) string {
+	mac := hmac.New(sha256.New, challenge)
+	mac.Write(data)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkProof returns true if the proof was made from the data with the challenge
+func checkProof(challenge, data []byte, proof string) bool {
+	p, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, challenge)
+	mac.Write(data)
+	return hmac.Equal(p, mac.Sum(nil))
+}
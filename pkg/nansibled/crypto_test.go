@@ -0,0 +1,110 @@
+package nansibled
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestSealPayload(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	otherPub, otherPriv, _ := box.GenerateKey(rand.Reader)
+	data := []byte("- hosts: all\n  tasks: []\n")
+
+	sealed, err := SealPayload(EncodeKey(pub), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains([]byte(sealed), data) || bytes.Contains([]byte(sealed), []byte(base64.StdEncoding.EncodeToString(data))) {
+		t.Fatal("sealed payload contains the plain text")
+	}
+
+	opened, err := OpenPayload(sealed, pub, priv)
+	if err != nil || !bytes.Equal(opened, data) {
+		t.Fatalf("OpenPayload = %q, %v", opened, err)
+	}
+
+	// sealing twice gives different payloads so they can't be compared
+	if again, _ := SealPayload(EncodeKey(pub), data); again == sealed {
+		t.Error("sealing the same data twice gave the same payload")
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(sealed)
+	raw[len(raw)-1] ^= 1
+	tampered := base64.StdEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		desc    string
+		payload string
+		pub     *[32]byte
+		priv    *[32]byte
+	}{
+		{"another host", sealed, otherPub, otherPriv},
+		{"wrong public key", sealed, otherPub, priv},
+		{"tampered", tampered, pub, priv},
+		{"truncated", sealed[:len(sealed)/2], pub, priv},
+		{"not base64", "not base64!", pub, priv},
+		{"empty", "", pub, priv},
+	}
+
+	for _, tt := range tests {
+		if _, err := OpenPayload(tt.payload, tt.pub, tt.priv); err != ErrCantDecrypt {
+			t.Errorf("%s: got %v, want ErrCantDecrypt", tt.desc, err)
+		}
+	}
+}
+
+func TestSealPayloadKeys(t *testing.T) {
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	if k, err := ParseKey(EncodeKey(pub)); err != nil || *k != *pub {
+		t.Errorf("ParseKey(EncodeKey(k)) = %v, %v", k, err)
+	}
+
+	tests := []struct {
+		desc string
+		key  string
+		err  error
+	}{
+		{"no key", "", ErrNoPublicKey},
+		{"not base64", "not a key!", ErrInvalidKey},
+		{"too short", base64.StdEncoding.EncodeToString(pub[:16]), ErrInvalidKey},
+		{"too long", base64.StdEncoding.EncodeToString(append(pub[:], 0)), ErrInvalidKey},
+	}
+
+	for _, tt := range tests {
+		if _, err := SealPayload(tt.key, []byte("data")); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.desc, err, tt.err)
+		}
+	}
+}
+
+func TestProof(t *testing.T) {
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+	facts := []byte(`{"hostname":"web1","os_family":"Debian"}`)
+	proof := Prove(challenge, facts)
+
+	tests := []struct {
+		desc      string
+		challenge []byte
+		data      []byte
+		proof     string
+		ok        bool
+	}{
+		{"valid", challenge, facts, proof, true},
+		{"other challenge", []byte("fedcba9876543210fedcba9876543210"), facts, proof, false},
+		{"changed facts", challenge, []byte(`{"hostname":"web1","os_family":"RedHat"}`), proof, false},
+		{"no proof", challenge, facts, "", false},
+		{"not base64", challenge, facts, "not base64!", false},
+		{"truncated", challenge, facts, proof[:20], false},
+	}
+
+	for _, tt := range tests {
+		if got := checkProof(tt.challenge, tt.data, tt.proof); got != tt.ok {
+			t.Errorf("%s: checkProof = %v, want %v", tt.desc, got, tt.ok)
+		}
+	}
+}
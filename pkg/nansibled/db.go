@@ -5,12 +5,18 @@ import (
 )
 
 type db struct {
+	pool *zoom.Pool
+
 	hosts     *zoom.Collection
 	playbooks *zoom.Collection
+	versions  *zoom.Collection
 	groups    *zoom.Collection
 	// reqs      *zoom.Collection
-	deploys *zoom.Collection
-	keys    *zoom.Collection
+	deploys   *zoom.Collection
+	runs      *zoom.Collection
+	schedules *zoom.Collection
+	secrets   *zoom.Collection
+	keys      *zoom.Collection
 }
 
 func newDB(pool *zoom.Pool) *db {
@@ -22,10 +28,15 @@ func newDB(pool *zoom.Pool) *db {
 	}
 
 	return &db{
+		pool:      pool,
 		hosts:     ignoreErr(pool.NewCollectionWithOptions(new(host), zoom.DefaultCollectionOptions.WithIndex(true))),
 		playbooks: ignoreErr(pool.NewCollectionWithOptions(new(playbook), zoom.DefaultCollectionOptions.WithIndex(true))),
+		versions:  ignoreErr(pool.NewCollectionWithOptions(new(playbookVersion), zoom.DefaultCollectionOptions.WithIndex(true))),
 		groups:    ignoreErr(pool.NewCollectionWithOptions(new(group), zoom.DefaultCollectionOptions.WithIndex(true))),
 		deploys:   ignoreErr(pool.NewCollectionWithOptions(new(deploy), zoom.DefaultCollectionOptions.WithIndex(true))),
+		runs:      ignoreErr(pool.NewCollectionWithOptions(new(run), zoom.DefaultCollectionOptions.WithIndex(true))),
+		schedules: ignoreErr(pool.NewCollectionWithOptions(new(schedule), zoom.DefaultCollectionOptions.WithIndex(true))),
+		secrets:   ignoreErr(pool.NewCollectionWithOptions(new(secret), zoom.DefaultCollectionOptions.WithIndex(true))),
 		keys:      ignoreErr(pool.NewCollectionWithOptions(new(key), zoom.DefaultCollectionOptions.WithIndex(true))),
 		// reqs:      ignoreErr(pool.NewCollectionWithOptions(new(http.Request), zoom.DefaultCollectionOptions.WithIndex(true))),
 	}
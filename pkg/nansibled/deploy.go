@@ -2,6 +2,7 @@ package nansibled
 
 import (
 	"context"
+	"crypto/ed25519"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -16,36 +17,61 @@ var (
 	stateSuccess = deployState("success")
 	stateError   = deployState("error")
 
+	stateRolledBack = deployState("rolled_back")
+	stateCancelled  = deployState("cancelled")
+	stateSkipped    = deployState("skipped")
+	stateTimedOut   = deployState("timed_out")
+
 	maxDeployTime = 30 * time.Minute
+	messageTTL    = 5 * time.Minute
 )
 
 type deploy struct {
 	ID         string
 	StartedAt  time.Time
 	FinishedAt time.Time
-	State      deployState // new,sent,acked,error,success
-	Host       string
-	Playbook   string
+	State      deployState `zoom:"index"` // new,sent,acked,error,success,rolled_back,cancelled,skipped,timed_out
+	Host       string      `zoom:"index"`
+	Playbook   string      `zoom:"index"`
+	Run        string      `zoom:"index"`
+	Version    int
+	MD5        string
 	SuccessAt  time.Time
 	ErrorAt    time.Time
 	AckedAt    time.Time
 	Error      string
+	Output     string
+	Result     *DeployResult
+
+	RollbackOnFailure bool
+	RolledBackTo      string
+	RollbackError     string
+	RollbackOutput    string
 
-	hst    *host
-	pb     *playbook
-	ctx    context.Context
-	nc     *nats.Conn
-	done   chan struct{}
-	onSync func(*host, *deploy)
+	CancelledBy string
+	CancelledAt time.Time
+
+	hst     *host
+	pb      *playbook
+	ctx     context.Context
+	nc      *nats.Conn
+	done    chan struct{}
+	onSync  func(*host, *deploy)
+	keys    []ed25519.PrivateKey
+	vars    []byte
+	secrets []string
+	store   *db
 }
 
 func newDeploy(nc *nats.Conn, hst *host, pb *playbook) *deploy {
 	d := new(deploy)
-	d.ID = "abcd" //uuid.New().String()
+	d.ID = makeToken()[:16]
 	d.hst = hst
 	d.pb = pb
 	d.Host = hst.Name
 	d.Playbook = pb.Name
+	d.Version = pb.Version
+	d.MD5 = pb.MD5
 	d.nc = nc
 	d.done = make(chan struct{})
 	d.onSync = func(*host, *deploy) {}
@@ -72,72 +98,254 @@ func (dpy *deploy) OnSync(cb func(*host, *deploy)) {
 	dpy.onSync = cb
 }
 
+// SignWith sets the keys that the messages sent to the host are signed with
+func (dpy *deploy) SignWith(keys []ed25519.PrivateKey) {
+	dpy.keys = keys
+}
+
+// OffloadTo sets where payloads that are too big to send in the message are kept
+// for the host to fetch
+func (dpy *deploy) OffloadTo(store *db) {
+	dpy.store = store
+}
+
+// SetVars sets the extra-vars json that is sent to the host with the playbook,
+// and the secret values in it that are redacted from what the host sends back
+func (dpy *deploy) SetVars(data []byte, secrets []string) {
+	dpy.vars = data
+	dpy.secrets = secrets
+}
+
 func (dpy *deploy) Start(retries int, interval time.Duration) {
 	dpy.StartedAt = time.Now()
 	defer close(dpy.done)
-	defer func() { dpy.FinishedAt = time.Now() }()
-	defer dpy.onSync(dpy.hst, dpy)
+	defer func() {
+		dpy.FinishedAt = time.Now()
+		dpy.onSync(dpy.hst, dpy)
+	}()
 
 	dpy.hst.LastDeployedPlaybook = dpy.pb.Name
 	dpy.onSync(dpy.hst, dpy)
 
+	nsg := NansibleMessage{}
+	nsg.Host = dpy.hst.Name
+	nsg.Playbook = dpy.Playbook
+	nsg.Deploy = dpy.ID
+	nsg.RollbackOnFailure = dpy.RollbackOnFailure
+	nsg.Entrypoint = dpy.pb.Entrypoint
+
+	nsg.Checksum = Checksum(dpy.pb.Bytes())
+
+	var err error
+	if len(dpy.vars) > 0 {
+		if nsg.Vars, err = SealPayload(dpy.hst.PublicKey, dpy.vars); err != nil {
+			dpy.fail(err.Error())
+			return
+		}
+	}
+
+	// only the hash of the playbook is offered at first, the playbook itself is
+	// sent if the host replies that it doesn't have it cached
+	offered := true
 	for retries > 0 {
 		dpy.State = stateSent
 		dpy.hst.State = stateSent
 		dpy.hst.LastDeployedAt = time.Now()
 		dpy.onSync(dpy.hst, dpy)
 
-		nsg := NansibleMessage{}
-		nsg.Host = dpy.hst.Name
-		nsg.Playbook = dpy.Playbook
-		nsg.Payload = dpy.pb.EncryptedString(dpy.hst.Name)
-		nsg.Deploy = dpy.ID
+		// each attempt gets a new nonce so the agent doesn't see retries as a replay
+		nsg.Stamp(messageTTL)
 
-		msg, err := dpy.nc.Request("nansible."+dpy.hst.Name+".playbook", nsg.Bytes(), interval)
+		msg, err := dpy.nc.Request("nansible."+dpy.hst.Name+".playbook", nsg.Signed(dpy.keys...), interval)
 		if err == nil {
+			ack, err := ParseNanMsg(msg.Data)
+			switch {
+			case err != nil:
+				dpy.fail("invalid ack: " + err.Error())
+				return
+			case ack.Missing && offered:
+				offered = false
+				if err := attachPlaybook(dpy.nc, dpy.store, &nsg, dpy.pb, dpy.hst.PublicKey); err != nil {
+					dpy.fail(err.Error())
+					return
+				}
+
+				// give the host time to fetch the payload before retrying
+				if nsg.Artifact != "" && interval < artifactAckTimeout {
+					interval = artifactAckTimeout
+				}
+				continue
+			case ack.Error != "":
+				dpy.fail("rejected: " + ack.Error)
+				return
+			case ack.Payload != dpy.MD5:
+				dpy.fail("host received a playbook with the wrong checksum: " + ack.Payload)
+				return
+			}
+
 			dpy.State = stateAcked
 			dpy.hst.State = stateAcked
-			dpy.hst.LastAckedAt = time.Now()
-			dpy.hst.LastAckedPlaybook = string(msg.Data)
+			dpy.AckedAt = time.Now()
+			dpy.hst.LastAckedAt = dpy.AckedAt
+			dpy.hst.LastAckedPlaybook = dpy.Playbook
 			break
 		}
 
 		// bail out after 1 hour of waiting for ack
 		// inifinite retries (retries=0) are not actually infinite
 		if time.Since(dpy.StartedAt) > time.Hour {
-			dpy.State = stateError
-			dpy.hst.State = stateError
-			dpy.ErrorAt = time.Now()
-			dpy.Error = "abandoned"
-			dpy.hst.LastErrorAt = dpy.ErrorAt
-			dpy.hst.LastErrorPlaybook = ""
+			dpy.fail("abandoned")
 			return
 		}
 
 		retries--
 	}
+
+	if dpy.AckedAt.IsZero() {
+		dpy.fail("not acked")
+		return
+	}
 	dpy.onSync(dpy.hst, dpy)
 
 	ctx, cancel := context.WithTimeout(context.Background(), maxDeployTime)
+
+	// result parses the result from the agent, ignoring results for other deploys
+	result := func(msg *nats.Msg) (NansibleMessage, bool) {
+		res, err := ParseNanMsg(msg.Data)
+		if err != nil {
+			// older agents only send the output
+			return NansibleMessage{Payload: Redact(string(msg.Data), dpy.secrets)}, true
+		}
+		res.Redact(dpy.secrets)
+		return res, res.Deploy == "" || res.Deploy == dpy.ID
+	}
+
 	sub1, _ := dpy.nc.Subscribe("nansible."+dpy.hst.Name+".playbook.success", func(msg *nats.Msg) {
+		res, ok := result(msg)
+		if !ok {
+			return
+		}
+
 		defer cancel()
-		dpy.hst.LastSuccessAt = time.Now()
-		dpy.hst.LastSuccessPlaybook = string(msg.Data)
+		dpy.Output = res.Payload
+		dpy.Result = res.Result
+		dpy.SuccessAt = time.Now()
+		dpy.hst.LastSuccessAt = dpy.SuccessAt
+		dpy.hst.LastSuccessPlaybook = dpy.Playbook
+		dpy.hst.Drifted = false
+		dpy.hst.DriftDiff = ""
 		dpy.State = stateSuccess
 		dpy.hst.State = stateSuccess
 	})
 	defer sub1.Unsubscribe()
 
 	sub2, _ := dpy.nc.Subscribe("nansible."+dpy.hst.Name+".playbook.error", func(msg *nats.Msg) {
+		res, ok := result(msg)
+		if !ok {
+			return
+		}
+
 		defer cancel()
-		dpy.hst.LastErrorAt = time.Now()
-		dpy.hst.LastErrorPlaybook = string(msg.Data)
-		dpy.Error = "host error"
-		dpy.State = stateError
-		dpy.hst.State = stateError
+		dpy.Output = res.Payload
+		dpy.Result = res.Result
+		dpy.fail(failureReason(res))
+		if res.Rollback != nil {
+			dpy.RollbackError = res.Rollback.Error
+			dpy.RollbackOutput = res.Rollback.Payload
+		}
 	})
 	defer sub2.Unsubscribe()
+
+	sub3, _ := dpy.nc.Subscribe("nansible."+dpy.hst.Name+".playbook.rolled_back", func(msg *nats.Msg) {
+		res, ok := result(msg)
+		if !ok {
+			return
+		}
+
+		defer cancel()
+		dpy.Output = res.Payload
+		dpy.Result = res.Result
+		dpy.fail(failureReason(res))
+		dpy.State = stateRolledBack
+		dpy.hst.State = stateRolledBack
+		if res.Rollback != nil {
+			dpy.RolledBackTo = res.Rollback.Deploy
+			dpy.RollbackError = res.Rollback.Error
+			dpy.RollbackOutput = res.Rollback.Payload
+		}
+	})
+	defer sub3.Unsubscribe()
+
+	sub4, _ := dpy.nc.Subscribe("nansible."+dpy.hst.Name+".playbook.cancelled", func(msg *nats.Msg) {
+		res, ok := result(msg)
+		if !ok {
+			return
+		}
+
+		defer cancel()
+		dpy.Output = res.Payload
+		dpy.Result = res.Result
+		dpy.Error = res.Error
+		dpy.State = stateCancelled
+		dpy.hst.State = stateCancelled
+		if dpy.CancelledAt.IsZero() {
+			dpy.CancelledAt = time.Now()
+		}
+	})
+	defer sub4.Unsubscribe()
 	<-ctx.Done()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		dpy.fail("no result from host after " + maxDeployTime.String())
+		dpy.State = stateTimedOut
+		dpy.hst.State = stateTimedOut
+	}
+}
+
+// failureReason describes why the deploy failed, using the failed task if known
+func failureReason(res NansibleMessage) string {
+	if res.Result != nil {
+		if t := res.Result.FailedTask(); t != nil {
+			return t.String()
+		}
+	}
+
+	if res.Error != "" {
+		return res.Error
+	}
+
+	return "host error"
+}
+
+// skip marks the deploy as never sent to the host, without touching the host
+func (dpy *deploy) skip(reason string) {
+	dpy.State = stateSkipped
+	dpy.Error = reason
+	dpy.FinishedAt = time.Now()
+	dpy.onSync(dpy.hst, dpy)
+	close(dpy.done)
+}
+
+// cancel marks the deploy as cancelled before it was sent to the host, without
+// touching the host
+func (dpy *deploy) cancel(user string) {
+	dpy.State = stateCancelled
+	dpy.Error = "run was cancelled"
+	dpy.CancelledBy = user
+	dpy.CancelledAt = time.Now()
+	dpy.FinishedAt = dpy.CancelledAt
+	dpy.onSync(dpy.hst, dpy)
+	close(dpy.done)
+}
+
+// fail marks the deploy and host as errored with the given reason
+func (dpy *deploy) fail(reason string) {
+	dpy.State = stateError
+	dpy.hst.State = stateError
+	dpy.ErrorAt = time.Now()
+	dpy.Error = reason
+	dpy.hst.LastErrorAt = dpy.ErrorAt
+	dpy.hst.LastErrorPlaybook = dpy.Playbook
 }
 
 func (dpy deploy) ModelID() string      { return dpy.ID }
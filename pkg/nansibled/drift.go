@@ -0,0 +1,213 @@
+package nansibled
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	driftCheckTimeout = 10 * time.Minute
+	maxDriftChecks    = 10
+)
+
+type driftSummary struct {
+	Group     string    `json:"group"`
+	Hosts     int       `json:"hosts"`
+	Drifted   []string  `json:"drifted"`
+	Unchecked []string  `json:"unchecked"`
+	Errors    []string  `json:"errors"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// watchDrift periodically checks all the hosts for drift from the playbook they
+// last successfully deployed
+func (svr *Server) watchDrift(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+			svr.checkAllDrift()
+		}
+	}()
+}
+
+func (svr *Server) checkAllDrift() {
+	var hsts []*host
+	if err := svr.db.hosts.FindAll(&hsts); err != nil {
+		log.Println("ERROR: checkAllDrift(): ", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxDriftChecks)
+	for _, h := range hsts {
+		if h.PublicKey == "" || h.LastSuccessAt.IsZero() || h.State == stateSent || h.State == stateAcked {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(h *host) {
+			defer func() { <-sem; wg.Done() }()
+			if err := svr.checkDrift(h); err != nil {
+				log.Printf("ERROR: checkAllDrift(): %s: %s", h.Name, err)
+			}
+		}(h)
+	}
+	wg.Wait()
+}
+
+// lastSuccess finds the most recent deploy to the host that succeeded
+func (svr *Server) lastSuccess(hostname string) (*deploy, error) {
+	var dplys []*deploy
+	if err := svr.db.deploys.NewQuery().Filter("Host =", hostname).Filter("State =", stateSuccess).Run(&dplys); err != nil {
+		return nil, err
+	}
+
+	if len(dplys) == 0 {
+		return nil, errors.New("host has never been deployed to successfully")
+	}
+
+	sort.Slice(dplys, func(i, j int) bool { return dplys[i].StartedAt.After(dplys[j].StartedAt) })
+	return dplys[0], nil
+}
+
+// checkDrift asks the host to run the playbook it last deployed successfully in
+// check mode, marking it as drifted if anything would change
+func (svr *Server) checkDrift(h *host) error {
+	dply, err := svr.lastSuccess(h.Name)
+	if err != nil {
+		return err
+	}
+
+	pb, err := svr.findPlaybookVersion(dply.Playbook, dply.Version)
+	if err != nil {
+		return err
+	}
+
+	nsg := NansibleMessage{Host: h.Name, Playbook: pb.Name, Deploy: "check-" + makeToken()[:16], Entrypoint: pb.Entrypoint}
+	nsg.Checksum = Checksum(pb.Bytes())
+
+	data, secrets, err := svr.deployVars(h, pb, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > 0 {
+		if nsg.Vars, err = SealPayload(h.PublicKey, data); err != nil {
+			return err
+		}
+	}
+
+	h.DriftPlaybook = versionID(pb.Name, pb.Version)
+	h.DriftCheckedAt = time.Now()
+	h.DriftError = ""
+
+	reply, err := svr.requestCheck(h, pb, nsg)
+	if err == nil {
+		reply.Redact(secrets)
+		switch {
+		case reply.Result != nil:
+			h.Drifted = reply.Result.Recap.Changed > 0
+			h.DriftDiff = reply.Result.Diff()
+			h.DriftError = reply.Error
+		case reply.Error != "":
+			err = errors.New(reply.Error)
+		default:
+			err = errors.New("no check results from host")
+		}
+	}
+
+	if err != nil {
+		h.DriftError = err.Error()
+	}
+
+	if serr := svr.db.hosts.SaveFields([]string{"Drifted", "DriftPlaybook", "DriftDiff", "DriftError", "DriftCheckedAt"}, h); serr != nil {
+		return serr
+	}
+
+	return err
+}
+
+// requestCheck offers the host the hash of the playbook to check, sending the
+// playbook itself if the host replies that it doesn't have it cached
+func (svr *Server) requestCheck(h *host, pb *playbook, nsg NansibleMessage) (NansibleMessage, error) {
+	for offered := true; ; offered = false {
+		nsg.Stamp(messageTTL)
+
+		msg, err := svr.nc.Request("nansible."+h.Name+".check", nsg.Signed(svr.signers()...), driftCheckTimeout)
+		if err != nil {
+			return NansibleMessage{}, err
+		}
+
+		reply, err := ParseNanMsg(msg.Data)
+		if err != nil || !reply.Missing || !offered {
+			return reply, err
+		}
+
+		if err := attachPlaybook(svr.nc, svr.db, &nsg, pb, h.PublicKey); err != nil {
+			return reply, err
+		}
+	}
+}
+
+func (svr *Server) handleCheckHostDrift(c *gin.Context) {
+	h := new(host)
+	if err := svr.db.hosts.Find(c.Param("host"), h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if err := svr.checkDrift(h); err != nil {
+		abortWithError(c, 502, err)
+		return
+	}
+
+	c.JSON(200, h)
+}
+
+func (svr *Server) handleGroupDrift(c *gin.Context) {
+	g := new(group)
+	if err := svr.db.groups.Find(c.Param("name"), g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	hosts, err := svr.groupHosts(g)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	sum := driftSummary{Group: g.Name, Hosts: len(hosts), Drifted: []string{}, Unchecked: []string{}, Errors: []string{}}
+	for _, hostname := range hosts {
+		h := new(host)
+		if err := svr.db.hosts.Find(hostname, h); err != nil {
+			sum.Errors = append(sum.Errors, hostname)
+			continue
+		}
+
+		switch {
+		case h.DriftCheckedAt.IsZero():
+			sum.Unchecked = append(sum.Unchecked, hostname)
+		case h.DriftError != "" && !h.Drifted:
+			sum.Errors = append(sum.Errors, hostname)
+		case h.Drifted:
+			sum.Drifted = append(sum.Drifted, hostname)
+		}
+
+		if h.DriftCheckedAt.After(sum.CheckedAt) {
+			sum.CheckedAt = h.DriftCheckedAt
+		}
+	}
+
+	c.JSON(200, sum)
+}
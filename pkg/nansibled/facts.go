@@ -0,0 +1,150 @@
+package nansibled
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+)
+
+var factsTimeout = 30 * time.Second
+
+// Facts are what the agent knows about the machine it is running on
+type Facts struct {
+	Hostname            string    `json:"hostname"`
+	OS                  string    `json:"os"`
+	OSFamily            string    `json:"os_family"`
+	Distribution        string    `json:"distribution"`
+	DistributionVersion string    `json:"distribution_version"`
+	Kernel              string    `json:"kernel"`
+	Arch                string    `json:"arch"`
+	IPs                 []string  `json:"ips"`
+	CPUs                int       `json:"cpus"`
+	MemoryMB            int       `json:"memory_mb"`
+	AnsibleVersion      string    `json:"ansible_version"`
+	Source              string    `json:"source"` // setup or builtin
+	CollectedAt         time.Time `json:"collected_at"`
+}
+
+// collectFacts refreshes the facts of agents that say they have started, the facts
+// they publish can't be trusted as anyone on the bus could have sent them
+func (svr *Server) collectFacts() {
+	_, err := svr.nc.Subscribe("nansible.facts", func(msg *nats.Msg) {
+		nsg, err := ParseNanMsg(msg.Data)
+		if err != nil || nsg.Host == "" {
+			return
+		}
+
+		// hosts that aren't known yet have their facts gathered once they are found
+		if found, err := svr.db.hosts.Exists(nsg.Host); err != nil || !found {
+			return
+		}
+
+		go func(hostname string) {
+			if _, err := svr.refreshFacts(hostname); err != nil {
+				log.Printf("ERROR: collectFacts(): failed to get facts from %s: %s", hostname, err)
+			}
+		}(nsg.Host)
+	})
+
+	if err != nil {
+		log.Println("ERROR: collectFacts(): ", err)
+	}
+}
+
+// saveFacts stores the facts for a host that is already known, hosts are only
+// created when they answer a ping
+func (svr *Server) saveFacts(hostname string, facts *Facts) error {
+	found, err := svr.db.hosts.Exists(hostname)
+	if err != nil || !found {
+		return err
+	}
+
+	if facts.CollectedAt.IsZero() {
+		facts.CollectedAt = time.Now()
+	}
+
+	h := &host{Name: hostname, Facts: facts, FactsCollectedAt: facts.CollectedAt}
+	return svr.db.hosts.SaveFields([]string{"Facts", "FactsCollectedAt"}, h)
+}
+
+// refreshFacts asks the host to gather its facts again, sending it a challenge
+// sealed to its key that it has to prove the facts with
+func (svr *Server) refreshFacts(hostname string) (*Facts, error) {
+	h := new(host)
+	if err := svr.db.hosts.FindFields(hostname, []string{"PublicKey"}, h); err != nil {
+		return nil, err
+	}
+
+	challenge := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, challenge); err != nil {
+		return nil, err
+	}
+
+	nsg := NansibleMessage{Host: hostname}
+	var err error
+	if nsg.Payload, err = SealPayload(h.PublicKey, challenge); err != nil {
+		return nil, err
+	}
+	nsg.Stamp(messageTTL)
+
+	msg, err := svr.nc.Request("nansible."+hostname+".facts", nsg.Signed(svr.signers()...), factsTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := ParseNanMsg(msg.Data)
+	switch {
+	case err != nil:
+		return nil, err
+	case reply.Error != "":
+		return nil, errors.New(reply.Error)
+	case reply.Payload == "":
+		return nil, errors.New("no facts in reply from host")
+	case !checkProof(challenge, []byte(reply.Payload), reply.Proof):
+		return nil, errors.New("facts reply wasn't proven with the host's key")
+	}
+
+	facts := new(Facts)
+	if err := json.Unmarshal([]byte(reply.Payload), facts); err != nil {
+		return nil, errors.New("invalid facts from host: " + err.Error())
+	}
+
+	return facts, svr.saveFacts(hostname, facts)
+}
+
+func (svr *Server) handleHostFacts(c *gin.Context) {
+	h := new(host)
+	if err := svr.db.hosts.Find(c.Param("host"), h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if h.Facts == nil {
+		abortWithError(c, 404, errors.New("no facts have been collected from the host"))
+		return
+	}
+
+	c.JSON(200, h.Facts)
+}
+
+func (svr *Server) handleRefreshFacts(c *gin.Context) {
+	h := new(host)
+	if err := svr.db.hosts.Find(c.Param("host"), h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	facts, err := svr.refreshFacts(h.Name)
+	if err != nil {
+		abortWithError(c, 502, err)
+		return
+	}
+
+	c.JSON(200, facts)
+}
@@ -0,0 +1,327 @@
+package nansibled
+
+import (
+	"encoding/gob"
+	"errors"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	// vars are stored with gob so the types that json decodes into need registering
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// allGroups loads every group keyed by name, for walking the group tree
+func (svr *Server) allGroups() (map[string]*group, error) {
+	var gs []*group
+	if err := svr.db.groups.FindAll(&gs); err != nil {
+		return nil, err
+	}
+
+	groups := map[string]*group{}
+	for _, g := range gs {
+		groups[g.Name] = g
+	}
+	return groups, nil
+}
+
+// descendantOf returns true if the group is the ancestor or one of its descendants
+func descendantOf(groups map[string]*group, name, ancestor string) bool {
+	seen := map[string]bool{}
+	var walk func(string) bool
+	walk = func(n string) bool {
+		if n == name {
+			return true
+		}
+
+		g := groups[n]
+		if g == nil || seen[n] {
+			return false
+		}
+		seen[n] = true
+
+		for _, child := range g.Children {
+			if walk(child) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(ancestor)
+}
+
+// parentsOf returns the names of the groups that have the group as a child
+func parentsOf(groups map[string]*group, name string) []string {
+	parents := []string{}
+	for _, g := range groups {
+		for _, child := range g.Children {
+			if child == name {
+				parents = append(parents, g.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(parents)
+	return parents
+}
+
+// groupHosts returns the hosts in the group, which are the ones added to it, any
+// that currently match its selector, and the same for all of its descendants
+func (svr *Server) groupHosts(g *group) ([]string, error) {
+	groups, err := svr.allGroups()
+	if err != nil {
+		return nil, err
+	}
+	groups[g.Name] = g
+
+	var hsts []*host
+	seen := map[string]bool{}
+	visited := map[string]bool{}
+	names := []string{}
+
+	var walk func(*group) error
+	walk = func(g *group) error {
+		if g == nil || visited[g.Name] {
+			return nil
+		}
+		visited[g.Name] = true
+
+		for _, name := range g.Hosts {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+
+		if g.Selector != "" {
+			sel, err := parseSelector(g.Selector)
+			if err != nil {
+				return err
+			}
+
+			if hsts == nil {
+				if err := svr.db.hosts.FindAll(&hsts); err != nil {
+					return err
+				}
+			}
+
+			matched := []string{}
+			for _, h := range hsts {
+				if !seen[h.Name] && sel.Match(h) {
+					seen[h.Name] = true
+					matched = append(matched, h.Name)
+				}
+			}
+			sort.Strings(matched)
+			names = append(names, matched...)
+		}
+
+		for _, child := range g.Children {
+			if err := walk(groups[child]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return names, walk(g)
+}
+
+// groupVars merges the vars of the group's ancestors with its own, so that the
+// vars in child groups override the ones in their parents
+func groupVars(groups map[string]*group, name string) map[string]interface{} {
+	vars := map[string]interface{}{}
+	for k, v := range mergeGroupVars(groups, []string{name}) {
+		vars[k] = v.Value
+	}
+	return vars
+}
+
+// groupPlaybook returns the playbook assigned to the group, or the one assigned
+// to its nearest ancestor when it doesn't have one
+func groupPlaybook(groups map[string]*group, name string) string {
+	seen := map[string]bool{}
+	queue := []string{name}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+
+		g := groups[n]
+		if g == nil || seen[n] {
+			continue
+		}
+		seen[n] = true
+
+		if g.Playbook != "" {
+			return g.Playbook
+		}
+		queue = append(queue, parentsOf(groups, n)...)
+	}
+	return ""
+}
+
+// inheritPlaybook assigns the playbook of the nearest ancestor to the group if it
+// doesn't have one of its own
+func (svr *Server) inheritPlaybook(g *group) error {
+	if g.Playbook != "" {
+		return nil
+	}
+
+	groups, err := svr.allGroups()
+	if err != nil {
+		return err
+	}
+	groups[g.Name] = g
+
+	g.Playbook = groupPlaybook(groups, g.Name)
+	return nil
+}
+
+func (svr *Server) handleGetGroup(c *gin.Context) {
+	g := new(group)
+	if err := svr.db.groups.Find(c.Param("name"), g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	hosts, err := svr.groupHosts(g)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, struct {
+		*group
+		ResolvedHosts []string `json:"resolved_hosts"`
+	}{g, hosts})
+}
+
+func (svr *Server) handleSetGroupSelector(c *gin.Context) {
+	g := new(group)
+	if err := svr.db.groups.Find(c.Param("name"), g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	var body struct {
+		Selector string `json:"selector"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	if body.Selector != "" {
+		if _, err := parseSelector(body.Selector); err != nil {
+			abortWithError(c, 400, err)
+			return
+		}
+	}
+
+	g.Selector = body.Selector
+	if err := svr.db.groups.SaveFields([]string{"Selector"}, g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, g)
+}
+
+func (svr *Server) handleAddChildGroup(c *gin.Context) {
+	groups, err := svr.allGroups()
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	name, child := c.Param("name"), c.Param("child")
+	g := groups[name]
+	if g == nil || groups[child] == nil {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	for _, ch := range g.Children {
+		if ch == child {
+			c.JSON(200, g)
+			return
+		}
+	}
+
+	if descendantOf(groups, name, child) {
+		abortWithError(c, 409, errors.New("adding the child group would create a cycle"))
+		return
+	}
+
+	g.Children = append(g.Children, child)
+	if err := svr.db.groups.SaveFields([]string{"Children"}, g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, g)
+}
+
+func (svr *Server) handleRmChildGroup(c *gin.Context) {
+	g := new(group)
+	if err := svr.db.groups.Find(c.Param("name"), g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	children := []string{}
+	for _, ch := range g.Children {
+		if ch != c.Param("child") {
+			children = append(children, ch)
+		}
+	}
+
+	g.Children = children
+	if err := svr.db.groups.SaveFields([]string{"Children"}, g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, g)
+}
+
+func (svr *Server) handleSetGroupVars(c *gin.Context) {
+	g := new(group)
+	if err := svr.db.groups.Find(c.Param("name"), g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	vars := map[string]interface{}{}
+	if err := c.BindJSON(&vars); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	g.Vars = vars
+	if err := svr.db.groups.SaveFields([]string{"Vars"}, g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, g.Vars)
+}
+
+// handleGroupVars shows the vars for the group including the ones it inherits
+func (svr *Server) handleGroupVars(c *gin.Context) {
+	groups, err := svr.allGroups()
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if groups[c.Param("name")] == nil {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	c.JSON(200, groupVars(groups, c.Param("name")))
+}
@@ -1,7 +1,12 @@
 package nansibled
 
 import (
+	"encoding/json"
 	"errors"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -46,37 +51,261 @@ func (svr *Server) requestAuthorizer(c *gin.Context) {
 func (svr *Server) handleRmHostFromGroup(c *gin.Context) { c.AbortWithStatus(501) }
 
 func (svr *Server) handleHostDeploy(c *gin.Context) {
-	var h *host
-	if err := svr.db.hosts.Find(c.Param("name"), h); err != nil {
+	h := new(host)
+	if err := svr.db.hosts.Find(c.Param("host"), h); err != nil {
 		abortWithError(c, 500, err)
 		return
 	}
 
-	var pb *playbook
-	if err := svr.db.playbooks.Find(c.Param("playbook"), h); err != nil {
+	version, _ := strconv.Atoi(c.Query("version"))
+	pb, err := svr.findPlaybookVersion(c.Param("playbook"), version)
+	if err != nil {
 		abortWithError(c, 500, err)
 		return
 	}
 
-	dply := newDeploy(svr.nc, h, pb)
-	if err := svr.db.deploys.Save(dply); err != nil {
+	svr.deployToHost(c, h, pb)
+}
+
+// deployToHost starts the deploy and responds once the host has acked it
+func (svr *Server) deployToHost(c *gin.Context, h *host, pb *playbook) {
+	opts, err := parseDeployOptions(c)
+	if err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	dply, err := svr.startDeploy(h, pb, opts)
+	if err != nil {
 		abortWithError(c, 500, err)
 		return
 	}
 
-	go dply.Start(5, time.Second*5) // 25 sec timeout
 	<-dply.Acked()
 	if !dply.ErrorAt.IsZero() {
 		abortWithError(c, 504, errors.New(dply.Error))
 		return
 	}
 
+	c.JSON(202, map[string]string{"id": dply.ID})
+}
+
+// deployOptions are the per deploy settings given in the query string
+type deployOptions struct {
+	Rollback bool
+	Vars     map[string]interface{}
+
+	// for group deploys
+	BatchSize   string
+	MaxFail     float64
+	Pause       time.Duration
+	Canaries    []string
+	CanaryCount int
+	Soak        time.Duration
+	PromoteBy   time.Duration
+
+	run string
+}
+
+func parseDeployOptions(c *gin.Context) (deployOptions, error) {
+	return parseDeployValues(c.Request.URL.Query())
+}
+
+func parseDeployValues(q url.Values) (deployOptions, error) {
+	opts := deployOptions{
+		Rollback:  q.Get("rollback") == "true",
+		BatchSize: q.Get("batch_size"),
+		MaxFail:   100,
+	}
+
+	if v := q.Get("vars"); v != "" {
+		if err := json.Unmarshal([]byte(v), &opts.Vars); err != nil {
+			return opts, errors.New("invalid vars, expected a json object: " + err.Error())
+		}
+	}
+
+	if _, err := opts.batchSize(1); err != nil {
+		return opts, err
+	}
+
+	if v := q.Get("max_fail_percentage"); v != "" {
+		pc, err := strconv.ParseFloat(v, 64)
+		if err != nil || pc < 0 || pc > 100 {
+			return opts, errors.New("invalid max_fail_percentage")
+		}
+		opts.MaxFail = pc
+	}
+
+	if v := q.Get("canaries"); v != "" {
+		opts.Canaries = strings.Split(v, ",")
+	}
+
+	if v := q.Get("canary_count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, errors.New("invalid canary_count")
+		}
+		opts.CanaryCount = n
+	}
+
+	if v := q.Get("soak"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, errors.New("invalid soak: " + err.Error())
+		}
+		opts.Soak = d
+	}
+
+	if v := q.Get("promote_by"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, errors.New("invalid promote_by")
+		}
+		opts.PromoteBy = d
+	}
+
+	if v := q.Get("pause"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, errors.New("invalid pause: " + err.Error())
+		}
+		opts.Pause = d
+	}
+
+	return opts, nil
+}
+
+// newHostDeploy creates and saves a deploy of the playbook to the host
+func (svr *Server) newHostDeploy(h *host, pb *playbook, opts deployOptions) (*deploy, error) {
+	dply := newDeploy(svr.nc, h, pb)
+	dply.Run = opts.run
+	dply.RollbackOnFailure = opts.Rollback
+	dply.SignWith(svr.signers())
+	dply.OffloadTo(svr.db)
+
+	data, secrets, err := svr.deployVars(h, pb, opts.Vars)
+	if err != nil {
+		return nil, err
+	}
+	dply.SetVars(data, secrets)
+
+	if err := svr.db.deploys.Save(dply); err != nil {
+		return nil, err
+	}
+
 	dply.OnSync(func(hst *host, dply *deploy) {
-		svr.db.hosts.Save(dply.hst)
+		svr.db.hosts.SaveFields(deployFields, dply.hst)
 		svr.db.deploys.Save(dply)
 	})
 
-	c.JSON(202, map[string]string{"id": dply.ID})
+	return dply, nil
+}
+
+// runDeploy sends the deploy to the host in the background, keeping track of it
+// until it finishes
+func (svr *Server) runDeploy(dply *deploy) {
+	svr.rmu.Lock()
+	svr.running[dply.ID] = dply
+	svr.rmu.Unlock()
+
+	go func() {
+		dply.Start(5, time.Second*5) // 25 sec timeout
+
+		svr.rmu.Lock()
+		delete(svr.running, dply.ID)
+		svr.rmu.Unlock()
+	}()
+}
+
+// startDeploy saves the new deploy and sends it to the host in the background
+func (svr *Server) startDeploy(h *host, pb *playbook, opts deployOptions) (*deploy, error) {
+	dply, err := svr.newHostDeploy(h, pb, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	svr.runDeploy(dply)
+	return dply, nil
+}
+
+func (svr *Server) handleSetHostKey(c *gin.Context) {
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	pubkey := strings.TrimSpace(string(data))
+	if _, err := ParseKey(pubkey); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	h := new(host)
+	if err := svr.db.hosts.Find(c.Param("host"), h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	h.PublicKey = pubkey
+	if err := svr.db.hosts.SaveFields([]string{"PublicKey"}, h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, h)
+}
+
+func (svr *Server) handleListHosts(c *gin.Context) {
+	if c.Query("label") == "" {
+		q := svr.db.hosts.NewQuery()
+		if v := c.Query("drifted"); v != "" {
+			q = q.Filter("Drifted =", v == "true")
+		}
+
+		hsts := []*host{}
+		if err := q.Run(&hsts); err != nil {
+			abortWithError(c, 500, err)
+			return
+		}
+
+		c.JSON(200, hsts)
+		return
+	}
+
+	// labels are looked up in their own index, so get those hosts by name
+	labels := map[string]string{}
+	for _, sel := range c.QueryArray("label") {
+		ls, err := parseLabelSelector(sel)
+		if err != nil {
+			abortWithError(c, 400, err)
+			return
+		}
+		for k, v := range ls {
+			labels[k] = v
+		}
+	}
+
+	names, err := svr.hostsWithLabels(labels)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	hsts, err := svr.findHosts(names)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	res := []*host{}
+	for _, h := range hsts {
+		if v := c.Query("drifted"); v == "" || h.Drifted == (v == "true") {
+			res = append(res, h)
+		}
+	}
+
+	c.JSON(200, res)
 }
 
 func (svr *Server) handleAddHostToGroup(c *gin.Context) {
@@ -93,7 +322,7 @@ func (svr *Server) handleAddHostToGroup(c *gin.Context) {
 }
 
 func (svr *Server) handleCreateNewGroup(c *gin.Context) {
-	var g *group
+	g := new(group)
 	if err := c.BindJSON(g); err != nil {
 		abortWithError(c, 400, err)
 		return
@@ -104,6 +333,18 @@ func (svr *Server) handleCreateNewGroup(c *gin.Context) {
 		return
 	}
 
+	if reservedGroups[g.Name] {
+		abortWithError(c, 400, errors.New("group name "+g.Name+" is reserved by ansible"))
+		return
+	}
+
+	if g.Selector != "" {
+		if _, err := parseSelector(g.Selector); err != nil {
+			abortWithError(c, 400, err)
+			return
+		}
+	}
+
 	if err := svr.db.groups.Save(g); err != nil {
 		abortWithError(c, 500, err)
 		return
@@ -114,63 +355,55 @@ func (svr *Server) handleCreateNewGroup(c *gin.Context) {
 
 func (svr *Server) handleDeployGroup(c *gin.Context) {
 	name := c.Param("name")
-	var g *group
+	g := new(group)
 	if err := svr.db.groups.Find(name, g); err != nil {
 		abortWithError(c, 500, err)
 		return
 	}
 
+	if err := svr.inheritPlaybook(g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
 	if g.Playbook == "" {
 		abortWithError(c, 400, errors.New("group does not have a playbook assigned"))
 		return
 	}
 
-	var pb *playbook
-	if err := svr.db.playbooks.Find(g.Playbook, pb); err != nil {
+	version, _ := strconv.Atoi(c.Query("version"))
+	pb, err := svr.findPlaybookVersion(g.Playbook, version)
+	if err != nil {
 		abortWithError(c, 500, err)
 		return
 	}
 
-	res := map[string]map[string]string{}
-	res["errors"] = map[string]string{}
-	res["started"] = map[string]string{}
-	for _, hostname := range g.Hosts {
-		var h *host
-		if err := svr.db.hosts.Find(hostname, h); err != nil {
-			// TODO: log
-			res["errors"][hostname] = err.Error()
-			continue
-		}
-
-		dply := newDeploy(svr.nc, h, pb)
-		if err := svr.db.deploys.Save(dply); err != nil {
-			res["errors"][hostname] = err.Error()
-			continue
-		}
-
-		dply.OnSync(func(hst *host, dply *deploy) {
-			svr.db.hosts.Save(dply.hst)
-			svr.db.deploys.Save(dply)
-		})
+	opts, err := parseDeployOptions(c)
+	if err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
 
-		go dply.Start(5, time.Second*5)
-		svr.running = append(svr.running, dply)
-		res["started"][hostname] = dply.ID
+	hosts, err := svr.groupHosts(g)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
 	}
 
-	code := 202
-	if len(res["started"]) == 0 {
-		code = 500
+	r := newRun(g.Name, pb, c.GetString("user"))
+	if r.Canaries, err = opts.pickCanaries(hosts); err != nil {
+		abortWithError(c, 400, err)
+		return
 	}
-	c.JSON(code, res)
+
+	svr.respondWithRun(c, r, hosts, pb, opts)
 }
 
 func (svr *Server) handleRunningDeploys(c *gin.Context) {
 	ids := []string{}
-	for _, dpy := range svr.running {
-		if dpy.FinishedAt.IsZero() {
-			ids = append(ids, dpy.ID)
-		}
+	for _, dpy := range svr.runningDeploys() {
+		ids = append(ids, dpy.ID)
 	}
+	sort.Strings(ids)
 	c.JSON(200, ids)
 }
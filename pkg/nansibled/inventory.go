@@ -0,0 +1,157 @@
+package nansibled
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+var invalidGroupChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// reservedGroups are the names the inventory uses itself
+var reservedGroups = map[string]bool{"all": true, "ungrouped": true, "_meta": true}
+
+// inventoryName is the name of the group in the inventory, groups that were made
+// with a reserved name before they were refused are renamed so they can't replace
+// the inventory's own entries
+func inventoryName(name string) string {
+	if reservedGroups[name] {
+		return "group_" + name
+	}
+	return name
+}
+
+// inventoryGroup is a group in ansible's dynamic inventory format
+type inventoryGroup struct {
+	Hosts    []string               `json:"hosts,omitempty"`
+	Vars     map[string]interface{} `json:"vars,omitempty"`
+	Children []string               `json:"children,omitempty"`
+}
+
+// labelGroup is the name of the inventory group for hosts with the label, made
+// safe to use as an ansible group name
+func labelGroup(k, v string) string {
+	return invalidGroupChars.ReplaceAllString("label_"+k+"_"+v, "_")
+}
+
+// inventoryHostVars are the vars for the host itself, ansible gets the group vars
+// from the groups so they aren't merged in here
+func inventoryHostVars(h *host) map[string]interface{} {
+	vars := map[string]interface{}{}
+	for k, v := range h.Vars {
+		vars[k] = v
+	}
+
+	if len(h.Labels) > 0 {
+		vars["nansible_labels"] = h.Labels
+	}
+
+	// the host's name is the agent's hostname which may not resolve from elsewhere
+	if _, set := vars["ansible_host"]; !set && h.Facts != nil && len(h.Facts.IPs) > 0 {
+		vars["ansible_host"] = h.Facts.IPs[0]
+	}
+	return vars
+}
+
+// inventory builds an ansible dynamic inventory from the hosts and groups, with a
+// group for each label as well
+func (svr *Server) inventory() (map[string]interface{}, error) {
+	var hsts []*host
+	if err := svr.db.hosts.FindAll(&hsts); err != nil {
+		return nil, err
+	}
+
+	groups, err := svr.allGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	hostvars := map[string]interface{}{}
+	for _, h := range hsts {
+		hostvars[h.Name] = inventoryHostVars(h)
+	}
+
+	inv := map[string]interface{}{}
+	grouped := map[string]bool{}
+	topLevel := []string{}
+	for name, g := range groups {
+		ig := &inventoryGroup{Vars: g.Vars}
+		for _, child := range g.Children {
+			ig.Children = append(ig.Children, inventoryName(child))
+		}
+
+		for _, h := range hsts {
+			if inGroup(g, h) {
+				ig.Hosts = append(ig.Hosts, h.Name)
+				grouped[h.Name] = true
+			}
+		}
+		sort.Strings(ig.Hosts)
+		inv[inventoryName(name)] = ig
+
+		if len(parentsOf(groups, name)) == 0 {
+			topLevel = append(topLevel, inventoryName(name))
+		}
+	}
+
+	labelled := map[string]*inventoryGroup{}
+	for _, h := range hsts {
+		for k, v := range h.Labels {
+			name := labelGroup(k, v)
+			if _, taken := groups[name]; taken {
+				continue
+			}
+
+			if labelled[name] == nil {
+				labelled[name] = &inventoryGroup{}
+				topLevel = append(topLevel, name)
+			}
+			labelled[name].Hosts = append(labelled[name].Hosts, h.Name)
+			grouped[h.Name] = true
+		}
+	}
+
+	for name, ig := range labelled {
+		sort.Strings(ig.Hosts)
+		inv[name] = ig
+	}
+
+	ungrouped := &inventoryGroup{}
+	for _, h := range hsts {
+		if !grouped[h.Name] {
+			ungrouped.Hosts = append(ungrouped.Hosts, h.Name)
+		}
+	}
+	sort.Strings(ungrouped.Hosts)
+	inv["ungrouped"] = ungrouped
+
+	sort.Strings(topLevel)
+	inv["all"] = &inventoryGroup{Children: append(topLevel, "ungrouped")}
+	inv["_meta"] = map[string]interface{}{"hostvars": hostvars}
+	return inv, nil
+}
+
+// handleInventory returns the whole inventory, or the vars for one host when the
+// host is given, as ansible asks with --list and --host
+func (svr *Server) handleInventory(c *gin.Context) {
+	if name := c.Query("host"); name != "" {
+		h := new(host)
+		if err := svr.db.hosts.Find(name, h); err != nil {
+			abortWithError(c, 404, errors.New("host not found"))
+			return
+		}
+
+		c.JSON(200, inventoryHostVars(h))
+		return
+	}
+
+	inv, err := svr.inventory()
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, inv)
+}
@@ -0,0 +1,223 @@
+package nansibled
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+)
+
+var labelKeyRx = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+
+// labelIndexKey is the redis set holding the names of the hosts with the label
+func labelIndexKey(k, v string) string { return "nansible:label:" + k + "=" + v }
+
+func validLabel(k, v string) error {
+	if !labelKeyRx.MatchString(k) {
+		return errors.New("invalid label key: " + k)
+	}
+
+	if strings.Contains(v, ",") {
+		return errors.New("label values can't contain commas")
+	}
+
+	return nil
+}
+
+// parseLabelSelector parses labels like env=prod,role=db, all of which a host
+// must have to match
+func parseLabelSelector(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, errors.New("invalid label selector, expected key=value: " + kv)
+		}
+
+		if err := validLabel(k, v); err != nil {
+			return nil, err
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// setLabels replaces the labels on the host, which must have its current labels
+// loaded so the index can be updated with what changed
+func (svr *Server) setLabels(h *host, labels map[string]string) error {
+	tx := svr.db.pool.NewTransaction()
+	for k, v := range h.Labels {
+		if nv, ok := labels[k]; !ok || nv != v {
+			tx.Command("SREM", redis.Args{labelIndexKey(k, v), h.Name}, nil)
+		}
+	}
+
+	for k, v := range labels {
+		if ov, ok := h.Labels[k]; !ok || ov != v {
+			tx.Command("SADD", redis.Args{labelIndexKey(k, v), h.Name}, nil)
+		}
+	}
+
+	h.Labels = labels
+	tx.SaveFields(svr.db.hosts, []string{"Labels"}, h)
+	return tx.Exec()
+}
+
+// hostsWithLabels returns the names of the hosts that have all of the labels
+func (svr *Server) hostsWithLabels(labels map[string]string) ([]string, error) {
+	if len(labels) == 0 {
+		return []string{}, nil
+	}
+
+	args := redis.Args{}
+	for k, v := range labels {
+		args = args.Add(labelIndexKey(k, v))
+	}
+
+	conn := svr.db.pool.NewConn()
+	defer conn.Close()
+
+	names, err := redis.Strings(conn.Do("SINTER", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// findHosts loads the named hosts in one round trip
+func (svr *Server) findHosts(names []string) ([]*host, error) {
+	hsts := make([]*host, len(names))
+	if len(names) == 0 {
+		return hsts, nil
+	}
+
+	tx := svr.db.pool.NewTransaction()
+	for i, name := range names {
+		hsts[i] = new(host)
+		tx.Find(svr.db.hosts, name, hsts[i])
+	}
+
+	return hsts, tx.Exec()
+}
+
+func (svr *Server) handleSetLabel(c *gin.Context) {
+	h := new(host)
+	if err := svr.db.hosts.Find(c.Param("host"), h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	k := c.Param("key")
+	if err := validLabel(k, body.Value); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	labels := map[string]string{}
+	for lk, lv := range h.Labels {
+		labels[lk] = lv
+	}
+	labels[k] = body.Value
+
+	if err := svr.setLabels(h, labels); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, h.Labels)
+}
+
+func (svr *Server) handleDeleteLabel(c *gin.Context) {
+	h := new(host)
+	if err := svr.db.hosts.Find(c.Param("host"), h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	k := c.Param("key")
+	if _, ok := h.Labels[k]; !ok {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	labels := map[string]string{}
+	for lk, lv := range h.Labels {
+		if lk != k {
+			labels[lk] = lv
+		}
+	}
+
+	if err := svr.setLabels(h, labels); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+// handleDeploySelector deploys a playbook to all the hosts matching a label
+// selector, without needing a group for them
+func (svr *Server) handleDeploySelector(c *gin.Context) {
+	sel := c.Query("selector")
+	if sel == "" {
+		abortWithError(c, 400, errors.New("selector is required"))
+		return
+	}
+
+	labels, err := parseLabelSelector(sel)
+	if err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	if c.Query("playbook") == "" {
+		abortWithError(c, 400, errors.New("playbook is required"))
+		return
+	}
+
+	version, _ := strconv.Atoi(c.Query("version"))
+	pb, err := svr.findPlaybookVersion(c.Query("playbook"), version)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	opts, err := parseDeployOptions(c)
+	if err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	hosts, err := svr.hostsWithLabels(labels)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if len(hosts) == 0 {
+		abortWithError(c, 404, errors.New("no hosts match the selector"))
+		return
+	}
+
+	r := newRun("selector:"+sel, pb, c.GetString("user"))
+	if r.Canaries, err = opts.pickCanaries(hosts); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	svr.respondWithRun(c, r, hosts, pb, opts)
+}
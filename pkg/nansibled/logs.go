@@ -0,0 +1,130 @@
+package nansibled
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+)
+
+type logLine struct {
+	Seq  int64     `json:"seq"`
+	Line string    `json:"line"`
+	At   time.Time `json:"at"`
+}
+
+func logKey(id string) string { return "nansible:deploylog:" + id }
+
+// appendLog stores the line in a sorted set by its sequence number, so that lines
+// arriving out of order are still read back in order
+func (db *db) appendLog(id string, l logLine) error {
+	conn := db.pool.NewConn()
+	defer conn.Close()
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("ZADD", logKey(id), l.Seq, data)
+	return err
+}
+
+// readLog returns the log lines for the deploy that come after the given sequence number
+func (db *db) readLog(id string, after int64) ([]logLine, error) {
+	conn := db.pool.NewConn()
+	defer conn.Close()
+
+	vals, err := redis.ByteSlices(conn.Do("ZRANGEBYSCORE", logKey(id), "("+strconv.FormatInt(after, 10), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []logLine{}
+	for _, v := range vals {
+		var l logLine
+		if err := json.Unmarshal(v, &l); err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+
+	return lines, nil
+}
+
+func (svr *Server) collectLogs() {
+	_, err := svr.nc.Subscribe("nansible.*.deploy.*.log", func(msg *nats.Msg) {
+		nsg, err := ParseNanMsg(msg.Data)
+		if err != nil || nsg.Deploy == "" {
+			return
+		}
+
+		line := nsg.Payload
+		if dply := svr.runningDeploy(nsg.Deploy); dply != nil {
+			line = Redact(line, dply.secrets)
+		}
+
+		if err := svr.db.appendLog(nsg.Deploy, logLine{Seq: nsg.Seq, Line: line, At: time.Now()}); err != nil {
+			log.Println("ERROR: collectLogs(): ", err)
+		}
+	})
+
+	if err != nil {
+		log.Println("ERROR: collectLogs(): ", err)
+	}
+}
+
+func (svr *Server) handleDeployLog(c *gin.Context) {
+	id := c.Param("name")
+	lines, err := svr.db.readLog(id, 0)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if c.Query("follow") != "true" {
+		c.JSON(200, lines)
+		return
+	}
+
+	var last int64
+	send := func(lines []logLine) {
+		for _, l := range lines {
+			c.SSEvent("log", l)
+			last = l.Seq
+		}
+	}
+
+	send(lines)
+	c.Stream(func(w io.Writer) bool {
+		dply := new(deploy)
+		if err := svr.db.deploys.Find(id, dply); err != nil {
+			c.SSEvent("error", err.Error())
+			return false
+		}
+
+		lines, err := svr.db.readLog(id, last)
+		if err != nil {
+			c.SSEvent("error", err.Error())
+			return false
+		}
+		send(lines)
+
+		if !dply.FinishedAt.IsZero() {
+			c.SSEvent("done", map[string]string{"id": dply.ID, "state": string(dply.State)})
+			return false
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-time.After(time.Second / 2):
+			return true
+		}
+	})
+}
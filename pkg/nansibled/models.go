@@ -8,58 +8,134 @@ import (
 )
 
 type playbook struct {
-	ID   string `json:"id,omitempty"`
-	Name string `json:"name,omitempty"`
-	Data string `json:"data,omitempty"`
+	ID         string    `json:"id,omitempty"`
+	Name       string    `json:"name,omitempty" zoom:"index"`
+	Version    int       `json:"version,omitempty" zoom:"index"`
+	MD5        string    `json:"md5,omitempty"`
+	UploadedBy string    `json:"uploaded_by,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at,omitempty"`
+	Data       string    `json:"data,omitempty"`
+
+	// bundles are stored separately by their hash, and Data holds the entrypoint
+	Bundle     string `json:"bundle,omitempty"`
+	Entrypoint string `json:"entrypoint,omitempty"`
+
+	bundle []byte
 }
 
-func (pb *playbook) EncryptedString(salt string) string {
-	return encryptWithSalt(salt, pb.Data)
+// Sealed returns the playbook encrypted to the given host public key
+func (pb *playbook) Sealed(pubkey string) (string, error) {
+	return SealPayload(pubkey, pb.Bytes())
 }
 
+// Bytes is what is sent to the host, which is the bundle if the playbook has one
 func (pb *playbook) Bytes() []byte {
+	if pb.bundle != nil {
+		return pb.bundle
+	}
 	return []byte(pb.Data)
 }
 
 func (pb *playbook) MD5SUM() string {
-	return fmt.Sprintf("%x", md5.Sum(pb.Bytes()))
+	return fmt.Sprintf("%x", md5.Sum(append(pb.Bytes(), pb.Entrypoint...)))
+}
+
+// text is all of the playbook's source, including every file in its bundle
+func (pb *playbook) text() (string, error) {
+	if pb.bundle == nil {
+		return pb.Data, nil
+	}
+
+	_, text, err := readBundle(pb.bundle, pb.Entrypoint)
+	return text, err
 }
 
 func (pb playbook) ModelID() string      { return pb.ID }
 func (pb *playbook) SetModelID(x string) { pb.ID = x }
 
+// playbookVersion is an immutable copy of a playbook as it was uploaded, the
+// playbook model itself always holds the latest version
+type playbookVersion playbook
+
+func versionID(name string, n int) string { return fmt.Sprintf("%s@%d", name, n) }
+
+func (pbv playbookVersion) ModelID() string      { return pbv.ID }
+func (pbv *playbookVersion) SetModelID(x string) { pbv.ID = x }
+
 type group struct {
 	Name     string   `json:"name,omitempty"`
 	Playbook string   `json:"playbook,omitempty" zoom:"index"`
 	Hosts    []string `json:"hosts,omitempty"`
+	Selector string   `json:"selector,omitempty"`
+	Children []string `json:"children,omitempty"`
+
+	Vars map[string]interface{} `json:"vars,omitempty"`
 }
 
 func (g group) ModelID() string      { return g.Name }
 func (g *group) SetModelID(x string) { g.Name = x }
 
 type host struct {
-	Name                 string      `json:"name"`
-	State                deployState `json:"state" zoom:"index"`
-	LastDeployedAt       time.Time   `json:"last_deployed_at"`
-	LastDeployedPlaybook string      `json:"last_deployed_playbook"`
-	LastAckedPlaybook    string      `json:"last_acked_playbook"`
-	LastAckedAt          time.Time   `json:"last_acked_at"`
-	LastSuccessPlaybook  string      `json:"last_success_playbook"`
-	LastSuccessAt        time.Time   `json:"last_success_at"`
-	LastErrorPlaybook    string      `json:"last_error_playbook"`
-	LastErrorAt          time.Time   `json:"last_error_at"`
-	LastSeenAt           time.Time   `json:"last_seen_at"`
+	Name                 string                 `json:"name"`
+	State                deployState            `json:"state" zoom:"index"`
+	LastDeployedAt       time.Time              `json:"last_deployed_at"`
+	LastDeployedPlaybook string                 `json:"last_deployed_playbook"`
+	LastAckedPlaybook    string                 `json:"last_acked_playbook"`
+	LastAckedAt          time.Time              `json:"last_acked_at"`
+	LastSuccessPlaybook  string                 `json:"last_success_playbook"`
+	LastSuccessAt        time.Time              `json:"last_success_at"`
+	LastErrorPlaybook    string                 `json:"last_error_playbook"`
+	LastErrorAt          time.Time              `json:"last_error_at"`
+	LastSeenAt           time.Time              `json:"last_seen_at"`
+	PublicKey            string                 `json:"public_key"`
+	Labels               map[string]string      `json:"labels,omitempty"`
+	Vars                 map[string]interface{} `json:"vars,omitempty"`
+	Drifted              bool                   `json:"drifted" zoom:"index"`
+	DriftPlaybook        string                 `json:"drift_playbook,omitempty"`
+	DriftDiff            string                 `json:"drift_diff,omitempty"`
+	DriftError           string                 `json:"drift_error,omitempty"`
+	DriftCheckedAt       time.Time              `json:"drift_checked_at"`
+	Facts                *Facts                 `json:"-"`
+	FactsCollectedAt     time.Time              `json:"facts_collected_at"`
+}
+
+// deployFields are the host fields that a deploy updates, the rest of the host
+// can change while the deploy is running so it is never saved from the deploy
+var deployFields = []string{
+	"State",
+	"LastDeployedAt", "LastDeployedPlaybook",
+	"LastAckedAt", "LastAckedPlaybook",
+	"LastSuccessAt", "LastSuccessPlaybook",
+	"LastErrorAt", "LastErrorPlaybook",
+	"Drifted", "DriftDiff",
 }
 
 func (h host) ModelID() string      { return h.Name }
 func (h *host) SetModelID(x string) { h.Name = x }
 
 type NansibleMessage struct {
-	Host     string `json:"host,omitempty"`
-	Playbook string `json:"playbook,omitempty"`
-	Payload  string `json:"payload,omitempty"`
-	Deploy   string `json:"deploy,omitempty"`
-	Error    string `json:"error,omitempty"`
+	Host              string            `json:"host,omitempty"`
+	Playbook          string            `json:"playbook,omitempty"`
+	Payload           string            `json:"payload,omitempty"`
+	Vars              string            `json:"vars,omitempty"`       // sealed like the payload
+	Entrypoint        string            `json:"entrypoint,omitempty"` // the payload is a bundle when set
+	Artifact          string            `json:"artifact,omitempty"`   // content hash of a playbook too big to send inline
+	Size              int64             `json:"size,omitempty"`
+	Offset            int64             `json:"offset,omitempty"`
+	Checksum          string            `json:"checksum,omitempty"`
+	Missing           bool              `json:"missing,omitempty"` // the host doesn't have the playbook cached
+	Deploy            string            `json:"deploy,omitempty"`
+	Error             string            `json:"error,omitempty"`
+	PublicKey         string            `json:"public_key,omitempty"`
+	RollbackOnFailure bool              `json:"rollback_on_failure,omitempty"`
+	Rollback          *NansibleMessage  `json:"rollback,omitempty"`
+	Seq               int64             `json:"seq,omitempty"`
+	Result            *DeployResult     `json:"result,omitempty"`
+	Proof             string            `json:"proof,omitempty"` // MAC of the payload keyed with a challenge sealed to the host
+	Labels            map[string]string `json:"labels,omitempty"`
+	Nonce             string            `json:"nonce,omitempty"`
+	IssuedAt          int64             `json:"issued_at,omitempty"`
+	ExpiresAt         int64             `json:"expires_at,omitempty"`
 }
 
 func (nsg NansibleMessage) Bytes() []byte {
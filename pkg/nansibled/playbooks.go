@@ -0,0 +1,272 @@
+package nansibled
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultEntrypoint is the playbook that is run from a bundle when the upload
+// doesn't say which one to run
+const defaultEntrypoint = "site.yml"
+
+// savePlaybook stores the draft as the next version of the named playbook, if it
+// is the same as the latest version then that version is returned instead
+func (svr *Server) savePlaybook(draft playbook, user string) (*playbook, bool, error) {
+	name := draft.Name
+
+	svr.pbmu.Lock()
+	defer svr.pbmu.Unlock()
+
+	var curr playbook
+	found, err := svr.db.playbooks.Exists(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if found {
+		if err := svr.db.playbooks.Find(name, &curr); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// versions outlive the playbook being deleted, so they are counted from what
+	// is stored rather than the latest playbook
+	latest, err := svr.latestVersion(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	pb := playbook{
+		ID:         name,
+		Name:       name,
+		Version:    latest + 1,
+		UploadedBy: user,
+		UploadedAt: time.Now(),
+		Data:       draft.Data,
+		Entrypoint: draft.Entrypoint,
+		bundle:     draft.bundle,
+	}
+	pb.MD5 = pb.MD5SUM()
+
+	if found && curr.MD5 == pb.MD5 {
+		return &curr, false, nil
+	}
+
+	if pb.bundle != nil {
+		pb.Bundle = Checksum(pb.bundle)
+		if err := svr.db.saveBundle(pb.Bundle, pb.bundle); err != nil {
+			return nil, false, err
+		}
+	}
+
+	pbv := playbookVersion(pb)
+	pbv.ID = versionID(name, pb.Version)
+	if exists, err := svr.db.versions.Exists(pbv.ID); err != nil {
+		return nil, false, err
+	} else if exists {
+		return nil, false, fmt.Errorf("version %d of playbook %s already exists", pb.Version, name)
+	}
+
+	if err := svr.db.versions.Save(&pbv); err != nil {
+		return nil, false, err
+	}
+
+	if err := svr.db.playbooks.Save(&pb); err != nil {
+		return nil, false, err
+	}
+
+	return &pb, true, nil
+}
+
+// latestVersion returns the highest version stored for the playbook, or zero if
+// it has never been uploaded
+func (svr *Server) latestVersion(name string) (int, error) {
+	var pbvs []*playbookVersion
+	if err := svr.db.versions.NewQuery().Filter("Name =", name).Order("-Version").Limit(1).Exclude("Data").Run(&pbvs); err != nil {
+		return 0, err
+	}
+
+	if len(pbvs) == 0 {
+		return 0, nil
+	}
+	return pbvs[0].Version, nil
+}
+
+// findPlaybookVersion will find the given version of the playbook, or the latest
+// version if n is zero
+func (svr *Server) findPlaybookVersion(name string, n int) (*playbook, error) {
+	pb := new(playbook)
+	if n == 0 {
+		if err := svr.db.playbooks.Find(name, pb); err != nil {
+			return nil, err
+		}
+	} else {
+		var pbv playbookVersion
+		if err := svr.db.versions.Find(versionID(name, n), &pbv); err != nil {
+			return nil, err
+		}
+
+		*pb = playbook(pbv)
+		pb.ID = name
+	}
+
+	if pb.Bundle != "" {
+		var err error
+		if pb.bundle, err = svr.db.loadBundle(pb.Bundle); err != nil {
+			return nil, err
+		}
+	}
+
+	return pb, nil
+}
+
+func (svr *Server) handleUploadPlaybook(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxBundleSize)
+
+	name := c.Query("name")
+	entrypoint := c.Query("entrypoint")
+
+	var data []byte
+	var err error
+	switch {
+	case strings.HasPrefix(c.ContentType(), "multipart/"):
+		var fh *multipart.FileHeader
+		if fh, err = c.FormFile("playbook"); err != nil {
+			abortWithError(c, 400, err)
+			return
+		}
+
+		if name == "" {
+			name = c.PostForm("name")
+		}
+
+		if entrypoint == "" {
+			entrypoint = c.PostForm("entrypoint")
+		}
+
+		if name == "" {
+			name = strings.TrimSuffix(strings.TrimSuffix(fh.Filename, filepath.Ext(fh.Filename)), ".tar")
+		}
+
+		var f multipart.File
+		if f, err = fh.Open(); err != nil {
+			abortWithError(c, 400, err)
+			return
+		}
+		defer f.Close()
+
+		data, err = io.ReadAll(f)
+	default:
+		data, err = io.ReadAll(c.Request.Body)
+	}
+
+	if err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	if name == "" {
+		abortWithError(c, 400, errors.New("playbook name not given"))
+		return
+	}
+
+	draft := playbook{Name: name, Data: string(data)}
+	if IsBundle(data) {
+		if entrypoint == "" {
+			entrypoint = defaultEntrypoint
+		}
+
+		if entrypoint, err = BundlePath(entrypoint); err != nil {
+			abortWithError(c, 400, errors.New("invalid entrypoint"))
+			return
+		}
+
+		yml, _, err := readBundle(data, entrypoint)
+		if err != nil {
+			abortWithError(c, 400, err)
+			return
+		}
+
+		draft = playbook{Name: name, Data: yml, Entrypoint: entrypoint, bundle: data}
+	}
+
+	var plays []interface{}
+	if err := yaml.Unmarshal([]byte(draft.Data), &plays); err != nil {
+		abortWithError(c, 400, errors.New("invalid playbook: "+err.Error()))
+		return
+	}
+
+	if len(plays) == 0 {
+		abortWithError(c, 400, errors.New("playbook has no plays"))
+		return
+	}
+
+	pb, created, err := svr.savePlaybook(draft, c.GetString("user"))
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	code := 200
+	if created {
+		code = 201
+	}
+	c.JSON(code, pb)
+}
+
+func (svr *Server) handlePlaybookVersions(c *gin.Context) {
+	pbvs := []*playbookVersion{}
+	if err := svr.db.versions.NewQuery().Filter("Name =", c.Param("name")).Order("Version").Exclude("Data").Run(&pbvs); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, pbvs)
+}
+
+func (svr *Server) handlePlaybookVersion(c *gin.Context) {
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil || n < 1 {
+		abortWithError(c, 400, errors.New("invalid version number"))
+		return
+	}
+
+	pb, err := svr.findPlaybookVersion(c.Param("name"), n)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, pb)
+}
+
+// handleDeletePlaybook removes the playbook so that it can no longer be deployed
+// by name, its versions are kept as past deploys refer to them, and uploading a
+// playbook with the same name again carries on from the last version
+func (svr *Server) handleDeletePlaybook(c *gin.Context) {
+	svr.pbmu.Lock()
+	defer svr.pbmu.Unlock()
+
+	ok, err := svr.db.playbooks.Delete(c.Param("name"))
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if !ok {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	c.Status(204)
+}
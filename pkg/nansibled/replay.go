@@ -0,0 +1,37 @@
+package nansibled
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNoNonce  = errors.New("message has no nonce")
+	ErrExpired  = errors.New("message has expired")
+	ErrTooEarly = errors.New("message was issued in the future")
+	ErrReplayed = errors.New("message has already been received")
+)
+
+// Stamp gives the message a new nonce and sets it to expire after the given ttl,
+// it needs to be signed again afterwards
+func (nsg *NansibleMessage) Stamp(ttl time.Duration) {
+	now := time.Now()
+	nsg.Nonce = makeToken()[:32]
+	nsg.IssuedAt = now.Unix()
+	nsg.ExpiresAt = now.Add(ttl).Unix()
+}
+
+// CheckFresh makes sure the message has a nonce and hasn't expired, allowing for
+// the given amount of clock skew between the server and agent
+func (nsg NansibleMessage) CheckFresh(skew time.Duration) error {
+	now := time.Now()
+	switch {
+	case nsg.Nonce == "":
+		return ErrNoNonce
+	case now.Add(-skew).After(time.Unix(nsg.ExpiresAt, 0)):
+		return ErrExpired
+	case now.Add(skew).Before(time.Unix(nsg.IssuedAt, 0)):
+		return ErrTooEarly
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package nansibled
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckFresh(t *testing.T) {
+	now := time.Now()
+	msg := func(nonce string, issued, expires time.Time) NansibleMessage {
+		return NansibleMessage{Nonce: nonce, IssuedAt: issued.Unix(), ExpiresAt: expires.Unix()}
+	}
+
+	tests := []struct {
+		desc string
+		nsg  NansibleMessage
+		err  error
+	}{
+		{"fresh", msg("n", now, now.Add(5*time.Minute)), nil},
+		{"no nonce", msg("", now, now.Add(5*time.Minute)), ErrNoNonce},
+		{"not stamped", NansibleMessage{}, ErrNoNonce},
+		{"expired", msg("n", now.Add(-10*time.Minute), now.Add(-5*time.Minute)), ErrExpired},
+		{"expired within skew", msg("n", now.Add(-5*time.Minute), now.Add(-30*time.Second)), nil},
+		{"from the future", msg("n", now.Add(5*time.Minute), now.Add(10*time.Minute)), ErrTooEarly},
+		{"ahead within skew", msg("n", now.Add(30*time.Second), now.Add(5*time.Minute)), nil},
+	}
+
+	for _, tt := range tests {
+		if err := tt.nsg.CheckFresh(time.Minute); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.desc, err, tt.err)
+		}
+	}
+
+	nsg := NansibleMessage{}
+	nsg.Stamp(time.Minute)
+	if err := nsg.CheckFresh(0); err != nil {
+		t.Errorf("newly stamped message: %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package nansibled
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DeployResult is the outcome of a playbook run as reported by ansible's json callback
+type DeployResult struct {
+	Recap Recap        `json:"recap"`
+	Tasks []TaskResult `json:"tasks"`
+}
+
+// Recap is the play recap counts for a host
+type Recap struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Failed      int `json:"failed"`
+	Skipped     int `json:"skipped"`
+	Unreachable int `json:"unreachable"`
+	Rescued     int `json:"rescued"`
+	Ignored     int `json:"ignored"`
+}
+
+type TaskResult struct {
+	Play     string  `json:"play"`
+	Name     string  `json:"name"`
+	Status   string  `json:"status"` // ok,changed,failed,skipped,unreachable
+	Duration float64 `json:"duration"`
+	Message  string  `json:"message,omitempty"`
+	Diff     string  `json:"diff,omitempty"`
+}
+
+// FailedTask returns the first task that failed or was unreachable
+func (res *DeployResult) FailedTask() *TaskResult {
+	for i, t := range res.Tasks {
+		if t.Status == "failed" || t.Status == "unreachable" {
+			return &res.Tasks[i]
+		}
+	}
+	return nil
+}
+
+type ansibleDuration struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (d ansibleDuration) seconds() float64 {
+	if d.Start.IsZero() || d.End.IsZero() {
+		return 0
+	}
+	return d.End.Sub(d.Start).Seconds()
+}
+
+type ansibleDiffFile struct {
+	Before       interface{} `json:"before"`
+	After        interface{} `json:"after"`
+	BeforeHeader string      `json:"before_header"`
+	AfterHeader  string      `json:"after_header"`
+	Prepared     string      `json:"prepared"`
+}
+
+// ansibleDiff is the diff from a task run with --diff, which is either a single
+// file or a list of them depending on the module
+type ansibleDiff []ansibleDiffFile
+
+func (d *ansibleDiff) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return json.Unmarshal(data, (*[]ansibleDiffFile)(d))
+	}
+
+	var f ansibleDiffFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*d = ansibleDiff{f}
+	return nil
+}
+
+func (d ansibleDiff) String() string {
+	buf := bytes.NewBufferString("")
+	for _, f := range d {
+		if f.Prepared != "" {
+			buf.WriteString(strings.TrimSuffix(f.Prepared, "\n") + "\n")
+			continue
+		}
+
+		before, after := diffText(f.Before), diffText(f.After)
+		if before == after {
+			continue
+		}
+
+		fmt.Fprintf(buf, "--- %s\n+++ %s\n", f.BeforeHeader, f.AfterHeader)
+		for _, l := range strings.Split(before, "\n") {
+			buf.WriteString("-" + l + "\n")
+		}
+		for _, l := range strings.Split(after, "\n") {
+			buf.WriteString("+" + l + "\n")
+		}
+	}
+	return buf.String()
+}
+
+func diffText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSuffix(v, "\n")
+	default:
+		data, _ := json.MarshalIndent(v, "", "  ")
+		return string(data)
+	}
+}
+
+type ansibleOutput struct {
+	Plays []struct {
+		Play struct {
+			Name string `json:"name"`
+		} `json:"play"`
+		Tasks []struct {
+			Task struct {
+				Name     string          `json:"name"`
+				Duration ansibleDuration `json:"duration"`
+			} `json:"task"`
+			Hosts map[string]struct {
+				Changed     bool        `json:"changed"`
+				Failed      bool        `json:"failed"`
+				Skipped     bool        `json:"skipped"`
+				Unreachable bool        `json:"unreachable"`
+				Msg         interface{} `json:"msg"`
+				Stderr      string      `json:"stderr"`
+				Diff        ansibleDiff `json:"diff"`
+			} `json:"hosts"`
+		} `json:"tasks"`
+	} `json:"plays"`
+	Stats map[string]struct {
+		Ok          int `json:"ok"`
+		Changed     int `json:"changed"`
+		Failures    int `json:"failures"`
+		Skipped     int `json:"skipped"`
+		Unreachable int `json:"unreachable"`
+		Rescued     int `json:"rescued"`
+		Ignored     int `json:"ignored"`
+	} `json:"stats"`
+}
+
+// ParseAnsibleJSON parses the output of ansible's json callback, as written to the
+// results file by the nansible_results callback plugin
+func ParseAnsibleJSON(stdout []byte) (*DeployResult, error) {
+	// warnings can be printed before the json starts
+	i := bytes.Index(stdout, []byte("\n{"))
+	switch {
+	case bytes.HasPrefix(stdout, []byte("{")):
+	case i >= 0:
+		stdout = stdout[i+1:]
+	default:
+		return nil, errors.New("no json found in ansible output")
+	}
+
+	var out ansibleOutput
+	if err := json.NewDecoder(bytes.NewReader(stdout)).Decode(&out); err != nil {
+		return nil, err
+	}
+
+	res := &DeployResult{Tasks: []TaskResult{}}
+	for _, play := range out.Plays {
+		for _, task := range play.Tasks {
+			hosts := make([]string, 0, len(task.Hosts))
+			for h := range task.Hosts {
+				hosts = append(hosts, h)
+			}
+			sort.Strings(hosts)
+
+			for _, h := range hosts {
+				hr := task.Hosts[h]
+				tr := TaskResult{
+					Play:     play.Play.Name,
+					Name:     task.Task.Name,
+					Status:   "ok",
+					Duration: task.Task.Duration.seconds(),
+					Diff:     hr.Diff.String(),
+				}
+
+				switch {
+				case hr.Unreachable:
+					tr.Status = "unreachable"
+				case hr.Failed:
+					tr.Status = "failed"
+				case hr.Skipped:
+					tr.Status = "skipped"
+				case hr.Changed:
+					tr.Status = "changed"
+				}
+
+				switch msg := hr.Msg.(type) {
+				case nil:
+					tr.Message = hr.Stderr
+				case string:
+					tr.Message = msg
+				default:
+					data, _ := json.Marshal(msg)
+					tr.Message = string(data)
+				}
+
+				res.Tasks = append(res.Tasks, tr)
+			}
+		}
+	}
+
+	for _, st := range out.Stats {
+		res.Recap.Ok += st.Ok
+		res.Recap.Changed += st.Changed
+		res.Recap.Failed += st.Failures
+		res.Recap.Skipped += st.Skipped
+		res.Recap.Unreachable += st.Unreachable
+		res.Recap.Rescued += st.Rescued
+		res.Recap.Ignored += st.Ignored
+	}
+
+	return res, nil
+}
+
+func (t TaskResult) String() string {
+	return fmt.Sprintf("task %q %s: %s", t.Name, t.Status, t.Message)
+}
+
+// Diff joins the diffs of all the tasks that would have made changes
+func (res *DeployResult) Diff() string {
+	buf := bytes.NewBufferString("")
+	for _, t := range res.Tasks {
+		if t.Diff == "" {
+			continue
+		}
+		fmt.Fprintf(buf, "TASK [%s]\n%s", t.Name, t.Diff)
+	}
+	return buf.String()
+}
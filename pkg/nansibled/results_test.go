@@ -0,0 +1,83 @@
+package nansibled
+
+import "testing"
+
+const ansibleJSON = `{
+  "plays": [{
+    "play": {"name": "web"},
+    "tasks": [
+      {
+        "task": {"name": "install nginx", "duration": {"start": "2024-01-01T00:00:00.000000Z", "end": "2024-01-01T00:00:02.500000Z"}},
+        "hosts": {
+          "web2": {"changed": true, "diff": [{"prepared": "+nginx\n"}]},
+          "web1": {"changed": false, "msg": "already installed"}
+        }
+      },
+      {
+        "task": {"name": "template config"},
+        "hosts": {
+          "web1": {"changed": true, "diff": {"before": "a\n", "after": "b\n", "before_header": "app.conf", "after_header": "app.conf"}}
+        }
+      },
+      {
+        "task": {"name": "restart"},
+        "hosts": {
+          "web1": {"failed": true, "stderr": "unit not found"},
+          "web2": {"failed": true, "msg": {"rc": 1}}
+        }
+      },
+      {
+        "task": {"name": "ping"},
+        "hosts": {"web3": {"unreachable": true, "failed": true, "msg": "no route"}}
+      }
+    ]
+  }],
+  "stats": {
+    "web1": {"ok": 2, "changed": 1, "failures": 1},
+    "web2": {"ok": 1, "changed": 1, "failures": 1, "ignored": 1},
+    "web3": {"unreachable": 1}
+  }
+}`
+
+func TestParseAnsibleJSON(t *testing.T) {
+	res, err := ParseAnsibleJSON([]byte("[WARNING]: something\n" + ansibleJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []TaskResult{
+		{Play: "web", Name: "install nginx", Status: "ok", Duration: 2.5, Message: "already installed"},
+		{Play: "web", Name: "install nginx", Status: "changed", Duration: 2.5, Diff: "+nginx\n"},
+		{Play: "web", Name: "template config", Status: "changed", Diff: "--- app.conf\n+++ app.conf\n-a\n+b\n"},
+		{Play: "web", Name: "restart", Status: "failed", Message: "unit not found"},
+		{Play: "web", Name: "restart", Status: "failed", Message: `{"rc":1}`},
+		{Play: "web", Name: "ping", Status: "unreachable", Message: "no route"},
+	}
+
+	if len(res.Tasks) != len(want) {
+		t.Fatalf("got %d tasks, want %d: %+v", len(res.Tasks), len(want), res.Tasks)
+	}
+
+	for i, tr := range res.Tasks {
+		if tr != want[i] {
+			t.Errorf("task %d = %+v, want %+v", i, tr, want[i])
+		}
+	}
+
+	recap := Recap{Ok: 3, Changed: 2, Failed: 2, Unreachable: 1, Ignored: 1}
+	if res.Recap != recap {
+		t.Errorf("recap = %+v, want %+v", res.Recap, recap)
+	}
+
+	if ft := res.FailedTask(); ft == nil || ft.Name != "restart" {
+		t.Errorf("failed task = %+v, want restart", ft)
+	}
+}
+
+func TestParseAnsibleJSONErrors(t *testing.T) {
+	for _, in := range []string{"", "ERROR! the playbook could not be found", `{"plays": [`} {
+		if _, err := ParseAnsibleJSON([]byte(in)); err == nil {
+			t.Errorf("ParseAnsibleJSON(%q) should have failed", in)
+		}
+	}
+}
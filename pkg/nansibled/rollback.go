@@ -0,0 +1,160 @@
+package nansibled
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+type rollbackTarget struct {
+	Host     string `json:"host"`
+	Playbook string `json:"playbook"`
+	From     int    `json:"from"`
+	Version  int    `json:"version"`
+	Deploy   string `json:"deploy"`
+}
+
+// knownGood finds the last version of the playbook that was successfully deployed
+// to the host, that is older than the version most recently deployed to it
+func (svr *Server) knownGood(hostname, playbook string) (*rollbackTarget, error) {
+	var dplys []*deploy
+	if err := svr.db.deploys.NewQuery().Filter("Host =", hostname).Filter("Playbook =", playbook).Run(&dplys); err != nil {
+		return nil, err
+	}
+
+	if len(dplys) == 0 {
+		return nil, errors.New("playbook has never been deployed to host")
+	}
+
+	curr, dply := lastGoodBefore(dplys)
+	if dply == nil {
+		return nil, errors.New("no known good version to roll back to")
+	}
+
+	return &rollbackTarget{
+		Host:     hostname,
+		Playbook: playbook,
+		From:     curr,
+		Version:  dply.Version,
+		Deploy:   dply.ID,
+	}, nil
+}
+
+// lastGoodBefore returns the version of the most recent deploy, and the most recent
+// successful deploy of an older version, so rolling back again keeps going back
+// rather than returning to a version that was rolled back from
+func lastGoodBefore(dplys []*deploy) (int, *deploy) {
+	sort.Slice(dplys, func(i, j int) bool { return dplys[i].StartedAt.After(dplys[j].StartedAt) })
+
+	curr := dplys[0].Version
+	for _, dply := range dplys {
+		if dply.State == stateSuccess && dply.Version < curr {
+			return curr, dply
+		}
+	}
+
+	return curr, nil
+}
+
+func (svr *Server) handleRollbackHost(c *gin.Context) {
+	h := new(host)
+	if err := svr.db.hosts.Find(c.Param("host"), h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	tgt, err := svr.knownGood(h.Name, c.Param("playbook"))
+	if err != nil {
+		abortWithError(c, 409, err)
+		return
+	}
+
+	if c.Query("dry_run") == "true" {
+		c.JSON(200, tgt)
+		return
+	}
+
+	pb, err := svr.findPlaybookVersion(tgt.Playbook, tgt.Version)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	svr.deployToHost(c, h, pb)
+}
+
+func (svr *Server) handleRollbackGroup(c *gin.Context) {
+	g := new(group)
+	if err := svr.db.groups.Find(c.Param("name"), g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if err := svr.inheritPlaybook(g); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if g.Playbook == "" {
+		abortWithError(c, 400, errors.New("group does not have a playbook assigned"))
+		return
+	}
+
+	hosts, err := svr.groupHosts(g)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	errs := map[string]string{}
+	tgts := map[string]*rollbackTarget{}
+	for _, hostname := range hosts {
+		tgt, err := svr.knownGood(hostname, g.Playbook)
+		if err != nil {
+			errs[hostname] = err.Error()
+			continue
+		}
+		tgts[hostname] = tgt
+	}
+
+	if c.Query("dry_run") == "true" {
+		c.JSON(200, map[string]interface{}{"errors": errs, "rollback": tgts})
+		return
+	}
+
+	opts, err := parseDeployOptions(c)
+	if err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	started := map[string]string{}
+	for hostname, tgt := range tgts {
+		h := new(host)
+		if err := svr.db.hosts.Find(hostname, h); err != nil {
+			errs[hostname] = err.Error()
+			continue
+		}
+
+		pb, err := svr.findPlaybookVersion(tgt.Playbook, tgt.Version)
+		if err != nil {
+			errs[hostname] = err.Error()
+			continue
+		}
+
+		dply, err := svr.startDeploy(h, pb, opts)
+		if err != nil {
+			errs[hostname] = err.Error()
+			continue
+		}
+
+		started[hostname] = dply.ID
+	}
+
+	code := 202
+	if len(started) == 0 {
+		code = 500
+	}
+	c.JSON(code, map[string]map[string]string{"errors": errs, "started": started})
+}
@@ -0,0 +1,38 @@
+package nansibled
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastGoodBefore(t *testing.T) {
+	at := func(min int) time.Time { return time.Date(2024, 1, 1, 0, min, 0, 0, time.UTC) }
+	dply := func(id string, version, min int, state deployState) *deploy {
+		return &deploy{ID: id, Version: version, StartedAt: at(min), State: state}
+	}
+
+	tests := []struct {
+		desc  string
+		dplys []*deploy
+		curr  int
+		want  string
+	}{
+		{"previous version", []*deploy{dply("a", 1, 1, stateSuccess), dply("b", 2, 2, stateSuccess)}, 2, "a"},
+		{"skips failures", []*deploy{dply("a", 1, 1, stateSuccess), dply("b", 2, 2, stateError), dply("c", 3, 3, stateError)}, 3, "a"},
+		{"rolled back once", []*deploy{dply("a", 1, 1, stateSuccess), dply("b", 2, 2, stateSuccess), dply("c", 3, 3, stateSuccess), dply("d", 2, 4, stateSuccess)}, 2, "a"},
+		{"nothing older", []*deploy{dply("a", 1, 1, stateSuccess), dply("b", 2, 2, stateSuccess), dply("c", 1, 3, stateSuccess)}, 1, ""},
+		{"only one", []*deploy{dply("a", 1, 1, stateSuccess)}, 1, ""},
+	}
+
+	for _, tt := range tests {
+		curr, got := lastGoodBefore(tt.dplys)
+		id := ""
+		if got != nil {
+			id = got.ID
+		}
+
+		if curr != tt.curr || id != tt.want {
+			t.Errorf("%s: got version %d and deploy %q, want %d and %q", tt.desc, curr, id, tt.curr, tt.want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package nansibled
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// batchSize works out how many of the hosts go in each batch, the batch size option
+// is either a count or a percentage of the hosts
+func (opts deployOptions) batchSize(hosts int) (int, error) {
+	if opts.BatchSize == "" {
+		return hosts, nil
+	}
+
+	if pc := strings.TrimSuffix(opts.BatchSize, "%"); pc != opts.BatchSize {
+		n, err := strconv.ParseFloat(pc, 64)
+		if err != nil || n <= 0 || n > 100 {
+			return 0, errors.New("invalid batch_size percentage")
+		}
+		return int(math.Max(1, math.Ceil(float64(hosts)*n/100))), nil
+	}
+
+	n, err := strconv.Atoi(opts.BatchSize)
+	if err != nil || n < 1 {
+		return 0, errors.New("invalid batch_size")
+	}
+	return n, nil
+}
+
+// pickCanaries returns the hosts given as canaries, or the canary count of hosts
+// picked at random
+func (opts deployOptions) pickCanaries(hosts []string) ([]string, error) {
+	var canaries []string
+	switch {
+	case len(opts.Canaries) > 0:
+		inGroup := map[string]bool{}
+		for _, h := range hosts {
+			inGroup[h] = true
+		}
+
+		for _, h := range opts.Canaries {
+			if !inGroup[h] {
+				return nil, fmt.Errorf("canary %s is not in the group", h)
+			}
+			delete(inGroup, h)
+			canaries = append(canaries, h)
+		}
+	case opts.CanaryCount > 0:
+		if opts.CanaryCount >= len(hosts) {
+			return nil, errors.New("canary_count must be less than the number of hosts")
+		}
+
+		for _, i := range rand.Perm(len(hosts))[:opts.CanaryCount] {
+			canaries = append(canaries, hosts[i])
+		}
+	}
+
+	return canaries, nil
+}
+
+func (svr *Server) saveRun(r *run) {
+	if err := svr.db.runs.Save(r); err != nil {
+		log.Println("ERROR: saveRun(): ", err)
+	}
+}
+
+// rollout deploys to the canaries of the run first, and only when they all succeed
+// and are promoted does it deploy to the rest of the hosts, the deploys not yet
+// started when the run is cancelled are marked as cancelled
+func (svr *Server) rollout(r *run, dplys []*deploy, opts deployOptions, cn *cancellation) {
+	defer svr.forgetRun(r.ID)
+
+	isCanary := map[string]bool{}
+	for _, h := range r.Canaries {
+		isCanary[h] = true
+	}
+
+	var canaries, rest []*deploy
+	for _, dply := range dplys {
+		if isCanary[dply.Host] {
+			canaries = append(canaries, dply)
+			continue
+		}
+		rest = append(rest, dply)
+	}
+
+	if len(canaries) > 0 && !svr.deployCanaries(r, canaries, opts, cn) {
+		reason := "canary failed"
+		if r.CanaryState == canaryExpired {
+			reason = "canaries were not promoted in time"
+		}
+
+		for _, dply := range rest {
+			if cn.cancelled() {
+				dply.cancel(cn.by)
+				continue
+			}
+			dply.skip(reason)
+		}
+	} else {
+		svr.deployBatches(rest, opts, cn)
+	}
+
+	if cn.cancelled() {
+		r.CancelledBy = cn.by
+		r.CancelledAt = cn.at
+	}
+
+	r.FinishedAt = time.Now()
+	if err := svr.tally(r); err != nil {
+		log.Println("ERROR: rollout(): ", err)
+	}
+	svr.saveRun(r)
+}
+
+// deployCanaries deploys to the canaries and waits for them to be promoted, either
+// by the soak time passing or through the API, returning false if any canary failed
+// or they weren't promoted before the deadline or the run was cancelled
+func (svr *Server) deployCanaries(r *run, canaries []*deploy, opts deployOptions, cn *cancellation) bool {
+	r.CanaryState = canaryDeploying
+	svr.saveRun(r)
+
+	for _, dply := range canaries {
+		svr.runDeploy(dply)
+	}
+
+	for _, dply := range canaries {
+		<-dply.Done()
+		if dply.State != stateSuccess {
+			r.CanaryState = canaryFailed
+		}
+	}
+
+	if cn.cancelled() {
+		r.CanaryState = canaryCancelled
+	}
+
+	if r.CanaryState == canaryFailed || r.CanaryState == canaryCancelled {
+		svr.saveRun(r)
+		return false
+	}
+
+	promote := svr.awaitPromotion(r.ID)
+	defer svr.forgetPromotion(r.ID)
+
+	if opts.Soak > 0 {
+		r.CanaryState = canarySoaking
+		svr.saveRun(r)
+
+		select {
+		case <-time.After(opts.Soak):
+			r.PromotedBy = "soak"
+		case r.PromotedBy = <-promote:
+		case <-cn.done:
+			r.CanaryState = canaryCancelled
+			svr.saveRun(r)
+			return false
+		}
+	} else {
+		deadline := opts.PromoteBy
+		if deadline == 0 {
+			deadline = promotionTimeout
+		}
+
+		r.CanaryState = canaryAwaiting
+		svr.saveRun(r)
+
+		select {
+		case <-time.After(deadline):
+			r.CanaryState = canaryExpired
+			svr.saveRun(r)
+			return false
+		case r.PromotedBy = <-promote:
+		case <-cn.done:
+			r.CanaryState = canaryCancelled
+			svr.saveRun(r)
+			return false
+		}
+	}
+
+	r.CanaryState = canaryPromoted
+	r.PromotedAt = time.Now()
+	svr.saveRun(r)
+	return true
+}
+
+// abandonRuns finishes the runs that were still going when the server stopped, as
+// the rollouts and any promotions they were waiting for only existed in memory,
+// the deploys that were never sent are skipped and the ones waiting on the host
+// are errored as their results can't be received any more
+func (svr *Server) abandonRuns() {
+	for _, state := range []deployState{stateSent, stateAcked} {
+		var dplys []*deploy
+		if err := svr.db.deploys.NewQuery().Filter("State =", state).Run(&dplys); err != nil {
+			log.Println("ERROR: abandonRuns(): ", err)
+			continue
+		}
+
+		for _, dply := range dplys {
+			dply.State = stateError
+			dply.Error = "nansibled restarted before the host sent a result"
+			dply.ErrorAt = time.Now()
+			dply.FinishedAt = dply.ErrorAt
+			if err := svr.db.deploys.SaveFields([]string{"State", "Error", "ErrorAt", "FinishedAt"}, dply); err != nil {
+				log.Println("ERROR: abandonRuns(): ", err)
+			}
+
+			hst := host{Name: dply.Host}
+			if err := svr.db.hosts.FindFields(dply.Host, []string{"State"}, &hst); err != nil {
+				continue
+			}
+
+			if hst.State == stateSent || hst.State == stateAcked {
+				hst.State = stateError
+				if err := svr.db.hosts.SaveFields([]string{"State"}, &hst); err != nil {
+					log.Println("ERROR: abandonRuns(): ", err)
+				}
+			}
+		}
+	}
+
+	var runs []*run
+	if err := svr.db.runs.FindAll(&runs); err != nil {
+		log.Println("ERROR: abandonRuns(): ", err)
+		return
+	}
+
+	for _, r := range runs {
+		if !r.FinishedAt.IsZero() {
+			continue
+		}
+
+		var dplys []*deploy
+		if err := svr.db.deploys.NewQuery().Filter("Run =", r.ID).Filter("State =", stateNew).Run(&dplys); err != nil {
+			log.Println("ERROR: abandonRuns(): ", err)
+			continue
+		}
+
+		for _, dply := range dplys {
+			dply.State = stateSkipped
+			dply.Error = "nansibled restarted during the run"
+			dply.FinishedAt = time.Now()
+			if err := svr.db.deploys.SaveFields([]string{"State", "Error", "FinishedAt"}, dply); err != nil {
+				log.Println("ERROR: abandonRuns(): ", err)
+			}
+		}
+
+		switch r.CanaryState {
+		case canaryDeploying, canarySoaking, canaryAwaiting:
+			r.CanaryState = canaryAbandoned
+		}
+
+		r.FinishedAt = time.Now()
+		if err := svr.tally(r); err != nil {
+			log.Println("ERROR: abandonRuns(): ", err)
+		}
+		svr.saveRun(r)
+	}
+}
+
+func (svr *Server) awaitPromotion(id string) chan string {
+	svr.pmu.Lock()
+	defer svr.pmu.Unlock()
+
+	if svr.promotions == nil {
+		svr.promotions = map[string]chan string{}
+	}
+
+	ch := make(chan string, 1)
+	svr.promotions[id] = ch
+	return ch
+}
+
+func (svr *Server) forgetPromotion(id string) {
+	svr.pmu.Lock()
+	defer svr.pmu.Unlock()
+	delete(svr.promotions, id)
+}
+
+// promote promotes the run's canaries, returning false if the run isn't waiting
+// to be promoted
+func (svr *Server) promote(id, user string) bool {
+	svr.pmu.Lock()
+	defer svr.pmu.Unlock()
+
+	ch, ok := svr.promotions[id]
+	if !ok {
+		return false
+	}
+
+	select {
+	case ch <- user:
+	default:
+	}
+	return true
+}
+
+// deployBatches deploys to the hosts in batches, waiting for each batch to finish
+// before starting the next one, if more than the max fail percentage of a batch
+// fails then the remaining hosts are skipped, and if the run is cancelled they are
+// cancelled
+func (svr *Server) deployBatches(dplys []*deploy, opts deployOptions, cn *cancellation) {
+	size, _ := opts.batchSize(len(dplys))
+	for i := 0; i < len(dplys); i += size {
+		if cn.cancelled() {
+			for _, dply := range dplys[i:] {
+				dply.cancel(cn.by)
+			}
+			return
+		}
+
+		end := i + size
+		if end > len(dplys) {
+			end = len(dplys)
+		}
+
+		batch := dplys[i:end]
+		for _, dply := range batch {
+			svr.runDeploy(dply)
+		}
+
+		failed := 0
+		for _, dply := range batch {
+			<-dply.Done()
+			if dply.State != stateSuccess {
+				failed++
+			}
+		}
+
+		if pc := float64(failed) * 100 / float64(len(batch)); pc > opts.MaxFail {
+			reason := fmt.Sprintf("%.0f%% of the previous batch failed", pc)
+			for _, dply := range dplys[end:] {
+				dply.skip(reason)
+			}
+			return
+		}
+
+		if end < len(dplys) {
+			select {
+			case <-time.After(opts.Pause):
+			case <-cn.done:
+			}
+		}
+	}
+}
+
+func (svr *Server) handlePromoteGroup(c *gin.Context) {
+	var runs []*run
+	if err := svr.db.runs.NewQuery().Filter("Group =", c.Param("name")).Run(&runs); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartedAt.After(runs[j].StartedAt) })
+	for _, r := range runs {
+		if svr.promote(r.ID, c.GetString("user")) {
+			c.JSON(202, map[string]string{"run": r.ID})
+			return
+		}
+	}
+
+	abortWithError(c, 409, errors.New("group has no run waiting to be promoted"))
+}
@@ -0,0 +1,30 @@
+package nansibled
+
+import "testing"
+
+func TestDeployBatchesCancelled(t *testing.T) {
+	var dplys []*deploy
+	for _, h := range []string{"web1", "web2", "web3"} {
+		dplys = append(dplys, newDeploy(nil, &host{Name: h}, &playbook{Name: "site"}))
+	}
+
+	svr := &Server{cancels: map[string]*cancellation{}}
+	cn := svr.trackRun("run1")
+	if !svr.cancelRun("run1", "alice") {
+		t.Fatal("run was not being tracked")
+	}
+
+	svr.deployBatches(dplys, deployOptions{BatchSize: "1"}, cn)
+
+	for _, dply := range dplys {
+		<-dply.Done()
+		if dply.State != stateCancelled || dply.CancelledBy != "alice" {
+			t.Errorf("deploy to %s is %q by %q, want cancelled by alice", dply.Host, dply.State, dply.CancelledBy)
+		}
+	}
+
+	svr.forgetRun("run1")
+	if svr.cancelRun("run1", "alice") {
+		t.Error("cancelled a run that was no longer rolling out")
+	}
+}
@@ -0,0 +1,227 @@
+package nansibled
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type canaryState string
+
+var (
+	canaryNone      = canaryState("")
+	canaryDeploying = canaryState("deploying")
+	canarySoaking   = canaryState("soaking")
+	canaryAwaiting  = canaryState("awaiting_promotion")
+	canaryPromoted  = canaryState("promoted")
+	canaryFailed    = canaryState("failed")
+	canaryExpired   = canaryState("promotion_expired")
+	canaryAbandoned = canaryState("abandoned")
+	canaryCancelled = canaryState("cancelled")
+
+	// promotionTimeout is how long canaries wait to be promoted when the deploy
+	// doesn't say, after which the rest of the run is skipped
+	promotionTimeout = 24 * time.Hour
+)
+
+// run is a deploy of a playbook to a group, which is made up of a deploy per host
+type run struct {
+	ID          string            `json:"id"`
+	Group       string            `json:"group" zoom:"index"`
+	Playbook    string            `json:"playbook"`
+	Version     int               `json:"version"`
+	StartedBy   string            `json:"started_by"`
+	StartedAt   time.Time         `json:"started_at"`
+	FinishedAt  time.Time         `json:"finished_at"`
+	RetryOf     string            `json:"retry_of,omitempty"`
+	Counts      map[string]int    `json:"counts"`  // deploy state to count
+	Deploys     map[string]string `json:"deploys"` // host to deploy ID
+	Canaries    []string          `json:"canaries,omitempty"`
+	CanaryState canaryState       `json:"canary_state,omitempty" zoom:"index"`
+	PromotedBy  string            `json:"promoted_by,omitempty"`
+	PromotedAt  time.Time         `json:"promoted_at,omitempty"`
+	CancelledBy string            `json:"cancelled_by,omitempty"`
+	CancelledAt time.Time         `json:"cancelled_at,omitempty"`
+}
+
+func newRun(group string, pb *playbook, user string) *run {
+	return &run{
+		ID:        makeToken()[:16],
+		Group:     group,
+		Playbook:  pb.Name,
+		Version:   pb.Version,
+		StartedBy: user,
+		StartedAt: time.Now(),
+		Counts:    map[string]int{},
+		Deploys:   map[string]string{},
+	}
+}
+
+func (r run) ModelID() string      { return r.ID }
+func (r *run) SetModelID(x string) { r.ID = x }
+
+// tally counts the deploys in the run by their state
+func (svr *Server) tally(r *run) error {
+	var dplys []*deploy
+	if err := svr.db.deploys.NewQuery().Filter("Run =", r.ID).Include("State").Run(&dplys); err != nil {
+		return err
+	}
+
+	r.Counts = map[string]int{}
+	for _, dply := range dplys {
+		state := string(dply.State)
+		if dply.State == stateNew {
+			state = "pending"
+		}
+		r.Counts[state]++
+	}
+
+	return nil
+}
+
+// startRun creates a deploy for each of the hosts and rolls them out in the background,
+// returning the errors for any hosts that couldn't be deployed to
+func (svr *Server) startRun(r *run, hosts []string, pb *playbook, opts deployOptions) (map[string]string, error) {
+	opts.run = r.ID
+	errs := map[string]string{}
+	var dplys []*deploy
+	for _, hostname := range hosts {
+		h := new(host)
+		if err := svr.db.hosts.Find(hostname, h); err != nil {
+			// TODO: log
+			errs[hostname] = err.Error()
+			continue
+		}
+
+		dply, err := svr.newHostDeploy(h, pb, opts)
+		if err != nil {
+			errs[hostname] = err.Error()
+			continue
+		}
+
+		dplys = append(dplys, dply)
+		r.Deploys[hostname] = dply.ID
+	}
+
+	if len(dplys) == 0 {
+		return errs, errors.New("no hosts could be deployed to")
+	}
+
+	if err := svr.db.runs.Save(r); err != nil {
+		return errs, err
+	}
+
+	go svr.rollout(r, dplys, opts, svr.trackRun(r.ID))
+	return errs, nil
+}
+
+// respondWithRun starts the run and responds with the deploys that were started
+func (svr *Server) respondWithRun(c *gin.Context, r *run, hosts []string, pb *playbook, opts deployOptions) {
+	errs, err := svr.startRun(r, hosts, pb, opts)
+	if err != nil {
+		c.JSON(500, map[string]interface{}{"error": err.Error(), "errors": errs, "started": r.Deploys})
+		return
+	}
+
+	c.JSON(202, map[string]interface{}{"run": r.ID, "errors": errs, "started": r.Deploys, "canaries": r.Canaries})
+}
+
+func (svr *Server) handleListRuns(c *gin.Context) {
+	runs := []*run{}
+	q := svr.db.runs.NewQuery()
+	if g := c.Query("group"); g != "" {
+		q = q.Filter("Group =", g)
+	}
+
+	if err := q.Run(&runs); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartedAt.After(runs[j].StartedAt) })
+
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 && n < len(runs) {
+		runs = runs[:n]
+	}
+
+	for _, r := range runs {
+		if !r.FinishedAt.IsZero() {
+			continue
+		}
+
+		if err := svr.tally(r); err != nil {
+			abortWithError(c, 500, err)
+			return
+		}
+	}
+
+	c.JSON(200, runs)
+}
+
+func (svr *Server) handleGetRun(c *gin.Context) {
+	r := new(run)
+	if err := svr.db.runs.Find(c.Param("id"), r); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if err := svr.tally(r); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, r)
+}
+
+// handleRetryFailed starts a new run of the same playbook version for just the
+// hosts in the run that errored or timed out
+func (svr *Server) handleRetryFailed(c *gin.Context) {
+	prev := new(run)
+	if err := svr.db.runs.Find(c.Param("id"), prev); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	var dplys []*deploy
+	if err := svr.db.deploys.NewQuery().Filter("Run =", prev.ID).Include("Host", "State").Run(&dplys); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	var hosts []string
+	for _, dply := range dplys {
+		if dply.State == stateError || dply.State == stateTimedOut {
+			hosts = append(hosts, dply.Host)
+		}
+	}
+	sort.Strings(hosts)
+
+	if len(hosts) == 0 {
+		abortWithError(c, 409, errors.New("run has no failed hosts to retry"))
+		return
+	}
+
+	pb, err := svr.findPlaybookVersion(prev.Playbook, prev.Version)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	opts, err := parseDeployOptions(c)
+	if err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	r := newRun(prev.Group, pb, c.GetString("user"))
+	r.RetryOf = prev.ID
+	if r.Canaries, err = opts.pickCanaries(hosts); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	svr.respondWithRun(c, r, hosts, pb, opts)
+}
@@ -0,0 +1,327 @@
+package nansibled
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	schedulerInterval = 15 * time.Second
+	maxScheduleRuns   = 100
+)
+
+// schedule deploys to a group or host once at a given time, or repeatedly on a
+// cron schedule
+type schedule struct {
+	ID        string            `json:"id"`
+	Group     string            `json:"group,omitempty"`
+	Host      string            `json:"host,omitempty"`
+	Playbook  string            `json:"playbook,omitempty"`
+	Version   int               `json:"version,omitempty"`
+	Cron      string            `json:"cron,omitempty"`
+	At        time.Time         `json:"at,omitempty"`
+	Options   map[string]string `json:"options,omitempty"`
+	Paused    bool              `json:"paused"`
+	NextRunAt time.Time         `json:"next_run_at"`
+	LastRunAt time.Time         `json:"last_run_at"`
+	CreatedBy string            `json:"created_by"`
+	CreatedAt time.Time         `json:"created_at"`
+	Runs      []scheduledRun    `json:"runs"`
+}
+
+// scheduledRun is a record of a deploy triggered by a schedule
+type scheduledRun struct {
+	At     time.Time `json:"at"`
+	Run    string    `json:"run,omitempty"`
+	Deploy string    `json:"deploy,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func (sch schedule) ModelID() string      { return sch.ID }
+func (sch *schedule) SetModelID(x string) { sch.ID = x }
+
+// validate checks the schedule is complete and works out when it will next run
+func (sch *schedule) validate() error {
+	switch {
+	case sch.Group == "" && sch.Host == "":
+		return errors.New("schedule needs a group or host to deploy to")
+	case sch.Group != "" && sch.Host != "":
+		return errors.New("schedule can't deploy to both a group and a host")
+	case sch.Host != "" && sch.Playbook == "":
+		return errors.New("schedule needs a playbook to deploy to the host")
+	case sch.Cron == "" && sch.At.IsZero():
+		return errors.New("schedule needs a cron expression or a time to run at")
+	case sch.Cron != "" && !sch.At.IsZero():
+		return errors.New("schedule can't have both a cron expression and a time to run at")
+	}
+
+	if _, err := parseDeployValues(sch.values()); err != nil {
+		return err
+	}
+
+	return sch.reschedule(time.Now())
+}
+
+func (sch *schedule) values() url.Values {
+	q := url.Values{}
+	for k, v := range sch.Options {
+		q.Set(k, v)
+	}
+	return q
+}
+
+// reschedule sets the next time the schedule should run after the given time, a
+// one off schedule that has already run won't run again
+func (sch *schedule) reschedule(after time.Time) error {
+	if sch.Cron == "" {
+		sch.NextRunAt = time.Time{}
+		if sch.LastRunAt.IsZero() {
+			sch.NextRunAt = sch.At
+		}
+		return nil
+	}
+
+	cs, err := cron.ParseStandard(sch.Cron)
+	if err != nil {
+		return errors.New("invalid cron expression: " + err.Error())
+	}
+
+	sch.NextRunAt = cs.Next(after)
+	return nil
+}
+
+func (svr *Server) runSchedules() {
+	for {
+		svr.triggerDueSchedules()
+		time.Sleep(schedulerInterval)
+	}
+}
+
+func (svr *Server) triggerDueSchedules() {
+	var schs []*schedule
+	if err := svr.db.schedules.FindAll(&schs); err != nil {
+		log.Println("ERROR: triggerDueSchedules(): ", err)
+		return
+	}
+
+	now := time.Now()
+	for _, sch := range schs {
+		if sch.Paused || sch.NextRunAt.IsZero() || sch.NextRunAt.After(now) {
+			continue
+		}
+
+		sr := svr.triggerSchedule(sch)
+		sch.LastRunAt = sr.At
+		sch.Runs = append(sch.Runs, sr)
+		if len(sch.Runs) > maxScheduleRuns {
+			sch.Runs = sch.Runs[len(sch.Runs)-maxScheduleRuns:]
+		}
+
+		if err := sch.reschedule(now); err != nil {
+			log.Println("ERROR: triggerDueSchedules(): ", err)
+		}
+
+		// only save what was changed here, so pauses and edits made through the
+		// API while the deploy was starting aren't lost
+		if err := svr.db.schedules.SaveFields([]string{"LastRunAt", "Runs", "NextRunAt"}, sch); err != nil {
+			log.Println("ERROR: triggerDueSchedules(): ", err)
+		}
+	}
+}
+
+// triggerSchedule starts the deploy for the schedule, recording the run or deploy it started
+func (svr *Server) triggerSchedule(sch *schedule) scheduledRun {
+	sr := scheduledRun{At: time.Now()}
+	user := "schedule:" + sch.ID
+
+	opts, err := parseDeployValues(sch.values())
+	if err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+
+	if sch.Host != "" {
+		h := new(host)
+		if err := svr.db.hosts.Find(sch.Host, h); err != nil {
+			sr.Error = err.Error()
+			return sr
+		}
+
+		pb, err := svr.findPlaybookVersion(sch.Playbook, sch.Version)
+		if err != nil {
+			sr.Error = err.Error()
+			return sr
+		}
+
+		dply, err := svr.startDeploy(h, pb, opts)
+		if err != nil {
+			sr.Error = err.Error()
+			return sr
+		}
+
+		sr.Deploy = dply.ID
+		return sr
+	}
+
+	g := new(group)
+	if err := svr.db.groups.Find(sch.Group, g); err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+
+	if err := svr.inheritPlaybook(g); err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+
+	name := sch.Playbook
+	if name == "" {
+		name = g.Playbook
+	}
+
+	if name == "" {
+		sr.Error = "group does not have a playbook assigned"
+		return sr
+	}
+
+	pb, err := svr.findPlaybookVersion(name, sch.Version)
+	if err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+
+	hosts, err := svr.groupHosts(g)
+	if err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+
+	r := newRun(g.Name, pb, user)
+	if r.Canaries, err = opts.pickCanaries(hosts); err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+
+	sr.Run = r.ID
+	if _, err := svr.startRun(r, hosts, pb, opts); err != nil {
+		sr.Error = err.Error()
+	}
+
+	return sr
+}
+
+func (svr *Server) handleListSchedules(c *gin.Context) {
+	schs := []*schedule{}
+	if err := svr.db.schedules.FindAll(&schs); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	sort.Slice(schs, func(i, j int) bool { return schs[i].CreatedAt.Before(schs[j].CreatedAt) })
+	c.JSON(200, schs)
+}
+
+func (svr *Server) handleCreateSchedule(c *gin.Context) {
+	sch := new(schedule)
+	if err := c.BindJSON(sch); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	sch.ID = makeToken()[:16]
+	sch.CreatedBy = c.GetString("user")
+	sch.CreatedAt = time.Now()
+	sch.LastRunAt = time.Time{}
+	sch.Runs = nil
+
+	if err := sch.validate(); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	if err := svr.db.schedules.Save(sch); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(201, sch)
+}
+
+func (svr *Server) handleUpdateSchedule(c *gin.Context) {
+	curr := new(schedule)
+	if err := svr.db.schedules.Find(c.Param("id"), curr); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	sch := new(schedule)
+	if err := c.BindJSON(sch); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	sch.ID = curr.ID
+	sch.CreatedBy = curr.CreatedBy
+	sch.CreatedAt = curr.CreatedAt
+	sch.LastRunAt = curr.LastRunAt
+	sch.Runs = curr.Runs
+
+	if err := sch.validate(); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	if err := svr.db.schedules.Save(sch); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, sch)
+}
+
+func (svr *Server) handleDeleteSchedule(c *gin.Context) {
+	ok, err := svr.db.schedules.Delete(c.Param("id"))
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if !ok {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	c.Status(204)
+}
+
+func (svr *Server) handlePauseSchedule(paused bool) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		sch := new(schedule)
+		if err := svr.db.schedules.Find(c.Param("id"), sch); err != nil {
+			abortWithError(c, 500, err)
+			return
+		}
+
+		sch.Paused = paused
+		if !paused {
+			// don't run everything that was missed while paused
+			if err := sch.reschedule(time.Now()); err != nil {
+				abortWithError(c, 500, err)
+				return
+			}
+		}
+
+		if err := svr.db.schedules.SaveFields([]string{"Paused", "NextRunAt"}, sch); err != nil {
+			abortWithError(c, 500, err)
+			return
+		}
+
+		c.JSON(200, sch)
+	}
+}
@@ -0,0 +1,63 @@
+package nansibled
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReschedule(t *testing.T) {
+	now := time.Date(2024, 3, 10, 14, 30, 0, 0, time.UTC)
+	at := now.Add(time.Hour)
+
+	tests := []struct {
+		desc string
+		sch  schedule
+		want time.Time
+		ok   bool
+	}{
+		{"hourly", schedule{Cron: "0 * * * *"}, time.Date(2024, 3, 10, 15, 0, 0, 0, time.UTC), true},
+		{"daily", schedule{Cron: "15 2 * * *"}, time.Date(2024, 3, 11, 2, 15, 0, 0, time.UTC), true},
+		{"weekly on monday", schedule{Cron: "0 9 * * 1"}, time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC), true},
+		{"descriptor", schedule{Cron: "@daily"}, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), true},
+		{"same minute runs next time", schedule{Cron: "30 14 * * *"}, time.Date(2024, 3, 11, 14, 30, 0, 0, time.UTC), true},
+		{"one off not run yet", schedule{At: at}, at, true},
+		{"one off already run", schedule{At: at, LastRunAt: now}, time.Time{}, true},
+		{"invalid cron", schedule{Cron: "every tuesday"}, time.Time{}, false},
+		{"too many fields", schedule{Cron: "0 0 * * * *"}, time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.sch.reschedule(now)
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: %v", tt.desc, err)
+		case !tt.ok && err == nil:
+			t.Errorf("%s: expected an error", tt.desc)
+		case tt.ok && !tt.sch.NextRunAt.Equal(tt.want):
+			t.Errorf("%s: next run at %v, want %v", tt.desc, tt.sch.NextRunAt, tt.want)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := []struct {
+		desc string
+		sch  schedule
+		ok   bool
+	}{
+		{"group on cron", schedule{Group: "web", Cron: "@hourly"}, true},
+		{"host at a time", schedule{Host: "web1", Playbook: "site", At: time.Now().Add(time.Hour)}, true},
+		{"no target", schedule{Cron: "@hourly"}, false},
+		{"both targets", schedule{Group: "web", Host: "web1", Playbook: "site", Cron: "@hourly"}, false},
+		{"host without playbook", schedule{Host: "web1", Cron: "@hourly"}, false},
+		{"no time", schedule{Group: "web"}, false},
+		{"cron and time", schedule{Group: "web", Cron: "@hourly", At: time.Now()}, false},
+		{"bad cron", schedule{Group: "web", Cron: "61 * * * *"}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.sch.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() error = %v, want ok %v", tt.desc, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package nansibled
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var (
+	ErrNoSecretsKey = errors.New("no secrets key loaded")
+
+	secretNameRx = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+	// playbooks use secrets as {{ secrets.name }} or {{ secrets['name'] }}, only
+	// the jinja expressions are looked in so paths like files/app_secrets.conf
+	// aren't taken as secrets
+	templateRx  = regexp.MustCompile(`(?s)\{\{.*?\}\}|\{%.*?%\}`)
+	secretRefRx = regexp.MustCompile(`(?:^|[^A-Za-z0-9_.])secrets(?:\.([A-Za-z0-9_]+)|\[\s*['"]([A-Za-z0-9_]+)['"]\s*\])`)
+)
+
+const redacted = "********"
+
+// secret is a value encrypted under the master key, that is only sent to the
+// hosts and groups it is scoped to
+type secret struct {
+	Name      string    `json:"name"`
+	Value     string    `json:"-"`
+	Groups    []string  `json:"groups"`
+	Hosts     []string  `json:"hosts"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s secret) ModelID() string      { return s.Name }
+func (s *secret) SetModelID(x string) { s.Name = x }
+
+// LoadSecretsKey loads the master key that secrets are encrypted with, a new key
+// is generated if the file doesn't exist yet
+func (svr *Server) LoadSecretsKey(fn string) error {
+	data, err := os.ReadFile(fn)
+	switch {
+	case os.IsNotExist(err):
+		key := new([32]byte)
+		if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(fn, []byte(base64.StdEncoding.EncodeToString(key[:])), 0600); err != nil {
+			return err
+		}
+
+		log.Println("generated a new secrets key in", fn, "keep a copy of it somewhere safe")
+		svr.secretsKey = key
+		return nil
+	case err != nil:
+		return err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != 32 {
+		return ErrInvalidKey
+	}
+
+	svr.secretsKey = new([32]byte)
+	copy(svr.secretsKey[:], raw)
+	return nil
+}
+
+func (svr *Server) encryptSecret(plain string) (string, error) {
+	if svr.secretsKey == nil {
+		return "", ErrNoSecretsKey
+	}
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", err
+	}
+
+	sealed := secretbox.Seal(nonce[:], []byte(plain), &nonce, svr.secretsKey)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (svr *Server) decryptSecret(enc string) (string, error) {
+	if svr.secretsKey == nil {
+		return "", ErrNoSecretsKey
+	}
+
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil || len(data) < 24 {
+		return "", ErrCantDecrypt
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], data[:24])
+	plain, ok := secretbox.Open(nil, data[24:], &nonce, svr.secretsKey)
+	if !ok {
+		return "", ErrCantDecrypt
+	}
+
+	return string(plain), nil
+}
+
+// secretRefs returns the names of the secrets used in the playbook
+func secretRefs(yml string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, expr := range templateRx.FindAllString(yml, -1) {
+		for _, m := range secretRefRx.FindAllStringSubmatch(expr, -1) {
+			name := m[1] + m[2]
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scopedTo returns true if the host is allowed to have the secret
+func (svr *Server) scopedTo(s *secret, h *host, groups map[string]*group) (bool, error) {
+	for _, name := range s.Hosts {
+		if name == h.Name {
+			return true, nil
+		}
+	}
+
+	for _, name := range s.Groups {
+		g := groups[name]
+		if g == nil {
+			continue
+		}
+
+		hosts, err := svr.groupHosts(g)
+		if err != nil {
+			return false, err
+		}
+
+		for _, hostname := range hosts {
+			if hostname == h.Name {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// hostSecrets decrypts the secrets used by the playbook that the host is allowed
+// to have, it is an error for the playbook to use any others
+func (svr *Server) hostSecrets(h *host, pb *playbook) (map[string]string, error) {
+	text, err := pb.text()
+	if err != nil {
+		return nil, err
+	}
+
+	names := secretRefs(text)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	groups, err := svr.allGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := map[string]string{}
+	for _, name := range names {
+		s := new(secret)
+		if err := svr.db.secrets.Find(name, s); err != nil {
+			return nil, errors.New("playbook uses secret " + name + " which can't be found")
+		}
+
+		ok, err := svr.scopedTo(s, h, groups)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return nil, errors.New("secret " + name + " is not scoped to host " + h.Name)
+		}
+
+		if secrets[name], err = svr.decryptSecret(s.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	return secrets, nil
+}
+
+// Redact replaces any of the secret values in the string, including where they
+// appear escaped in json output
+func Redact(s string, values []string) string {
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+
+		for _, form := range redactForms(v) {
+			s = strings.ReplaceAll(s, form, redacted)
+		}
+	}
+	return s
+}
+
+// redactForms returns the value as it is and how it looks inside a json string,
+// both as go writes it and as python does with its ascii escaping
+func redactForms(v string) []string {
+	forms := []string{v}
+	add := func(f string) {
+		for _, seen := range forms {
+			if seen == f {
+				return
+			}
+		}
+		forms = append(forms, f)
+	}
+
+	for _, html := range []bool{true, false} {
+		buf := bytes.NewBufferString("")
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(html)
+		enc.Encode(v)
+
+		quoted := strings.TrimSuffix(buf.String(), "\n")
+		add(quoted[1 : len(quoted)-1])
+	}
+
+	add(pythonJSON(v))
+	return forms
+}
+
+// pythonJSON escapes the string the way python's json module does by default
+func pythonJSON(v string) string {
+	buf := bytes.NewBufferString("")
+	for _, r := range v {
+		switch {
+		case r == '"':
+			buf.WriteString(`\"`)
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r == '\b':
+			buf.WriteString(`\b`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r < 0x20 || (r > 0x7e && r <= 0xffff):
+			fmt.Fprintf(buf, `\u%04x`, r)
+		case r > 0xffff:
+			r1, r2 := utf16.EncodeRune(r)
+			fmt.Fprintf(buf, `\u%04x\u%04x`, r1, r2)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// redactResult removes the secret values from the output of a deploy
+func redactResult(res *DeployResult, values []string) {
+	if res == nil || len(values) == 0 {
+		return
+	}
+
+	for i := range res.Tasks {
+		res.Tasks[i].Play = Redact(res.Tasks[i].Play, values)
+		res.Tasks[i].Name = Redact(res.Tasks[i].Name, values)
+		res.Tasks[i].Message = Redact(res.Tasks[i].Message, values)
+		res.Tasks[i].Diff = Redact(res.Tasks[i].Diff, values)
+	}
+}
+
+// Redact removes the secret values from the output and results in the message
+func (nsg *NansibleMessage) Redact(values []string) {
+	if len(values) == 0 {
+		return
+	}
+
+	nsg.Payload = Redact(nsg.Payload, values)
+	nsg.Error = Redact(nsg.Error, values)
+	redactResult(nsg.Result, values)
+	if nsg.Rollback != nil {
+		nsg.Rollback.Redact(values)
+	}
+}
+
+func (svr *Server) handleListSecrets(c *gin.Context) {
+	secrets := []*secret{}
+	if err := svr.db.secrets.FindAll(&secrets); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	c.JSON(200, secrets)
+}
+
+func (svr *Server) handleGetSecret(c *gin.Context) {
+	s := new(secret)
+	if err := svr.db.secrets.Find(c.Param("name"), s); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, s)
+}
+
+// handlePutSecret creates or replaces the secret, the value is never returned
+func (svr *Server) handlePutSecret(c *gin.Context) {
+	name := c.Param("name")
+	if !secretNameRx.MatchString(name) {
+		abortWithError(c, 400, errors.New("secret names can only contain letters, numbers and underscores"))
+		return
+	}
+
+	var body struct {
+		Value  string   `json:"value"`
+		Groups []string `json:"groups"`
+		Hosts  []string `json:"hosts"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	if body.Value == "" {
+		abortWithError(c, 400, errors.New("secret value is required"))
+		return
+	}
+
+	if len(body.Groups) == 0 && len(body.Hosts) == 0 {
+		abortWithError(c, 400, errors.New("secret must be scoped to at least one group or host"))
+		return
+	}
+
+	s := new(secret)
+	found, err := svr.db.secrets.Exists(name)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if found {
+		if err := svr.db.secrets.Find(name, s); err != nil {
+			abortWithError(c, 500, err)
+			return
+		}
+	} else {
+		s.Name = name
+		s.CreatedBy = c.GetString("user")
+		s.CreatedAt = time.Now()
+	}
+
+	if s.Value, err = svr.encryptSecret(body.Value); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	s.Groups = body.Groups
+	s.Hosts = body.Hosts
+	s.UpdatedBy = c.GetString("user")
+	s.UpdatedAt = time.Now()
+
+	if err := svr.db.secrets.Save(s); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	code := 200
+	if !found {
+		code = 201
+	}
+	c.JSON(code, s)
+}
+
+func (svr *Server) handleDeleteSecret(c *gin.Context) {
+	ok, err := svr.db.secrets.Delete(c.Param("name"))
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	if !ok {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	c.Status(204)
+}
@@ -0,0 +1,94 @@
+package nansibled
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSecretRefs(t *testing.T) {
+	tests := []struct {
+		yml  string
+		want string
+	}{
+		{`password: "{{ secrets.db }}"`, "db"},
+		{`password: "{{ secrets['db'] }}"`, "db"},
+		{`password: "{{ secrets[ "db" ] }}"`, "db"},
+		{`url: "{{ secrets.user }}:{{ secrets.pass }}@host"`, "pass,user"},
+		{`{% if secrets.flag %}on{% endif %}`, "flag"},
+		{`x: "{{ secrets.a | default(secrets.b) }}"`, "a,b"},
+		{`x: "{{ secrets.a }}" y: "{{ secrets.a }}"`, "a"},
+		{`src: files/app_secrets.conf`, ""},
+		{`include_vars: vault_secrets.yml`, ""},
+		{`dest: "{{ app_dir }}/app_secrets.conf"`, ""},
+		{`x: "{{ vault.secrets.db }}"`, ""},
+		{`x: "{{ mysecrets.db }}"`, ""},
+		{`secrets.db`, ""},
+	}
+
+	for _, tt := range tests {
+		if got := strings.Join(secretRefs(tt.yml), ","); got != tt.want {
+			t.Errorf("secretRefs(%q) = %q, want %q", tt.yml, got, tt.want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		desc   string
+		secret string
+		in     string
+	}{
+		{"plain", "hunter2", "the password is hunter2"},
+		{"quote", `pa"ss`, `{"msg": "pa\"ss"}`},
+		{"backslash", `pa\ss`, `{"msg": "pa\\ss"}`},
+		{"html go", "a<b>&c", `{"msg": "a\u003cb\u003e\u0026c"}`},
+		{"html python", "a<b>&c", `{"msg": "a<b>&c"}`},
+		{"unicode python", "pässwörd", `{"msg": "p\u00e4ssw\u00f6rd"}`},
+		{"unicode raw", "pässwörd", `{"msg": "pässwörd"}`},
+		{"astral python", "key🔑", `{"msg": "key\ud83d\udd11"}`},
+		{"newline", "line1\nline2", `{"msg": "line1\nline2"}`},
+	}
+
+	for _, tt := range tests {
+		got := Redact(tt.in, []string{tt.secret})
+		if !strings.Contains(got, redacted) {
+			t.Errorf("%s: %q was not redacted from %q", tt.desc, tt.secret, tt.in)
+		}
+	}
+
+	if got := Redact("nothing here", []string{"", "secret"}); got != "nothing here" {
+		t.Errorf("Redact changed text without secrets to %q", got)
+	}
+}
+
+func TestRedactEveryJSONForm(t *testing.T) {
+	secret := "p\"a\\s<s>&wörd\t🔑"
+
+	data, _ := json.Marshal(map[string]string{"msg": secret})
+	if got := Redact(string(data), []string{secret}); strings.Contains(got, "wörd") || !strings.Contains(got, redacted) {
+		t.Errorf("go json form not redacted: %s", got)
+	}
+
+	py := `{"msg": "` + pythonJSON(secret) + `"}`
+	if got := Redact(py, []string{secret}); !strings.Contains(got, redacted) {
+		t.Errorf("python json form not redacted: %s", got)
+	}
+}
+
+func TestRedactMessage(t *testing.T) {
+	nsg := NansibleMessage{
+		Payload: "out: s3cret",
+		Error:   "failed with s3cret",
+		Result: &DeployResult{Tasks: []TaskResult{
+			{Play: "play s3cret", Name: "task s3cret", Message: "msg s3cret", Diff: "+s3cret"},
+		}},
+		Rollback: &NansibleMessage{Payload: "rollback s3cret"},
+	}
+	nsg.Redact([]string{"s3cret"})
+
+	data, _ := json.Marshal(nsg)
+	if strings.Contains(string(data), "s3cret") {
+		t.Errorf("secret left in message: %s", data)
+	}
+}
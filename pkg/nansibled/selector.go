@@ -0,0 +1,298 @@
+package nansibled
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// selector matches hosts by their facts and labels, with expressions like:
+//
+//	os_family == "Debian" && label.role == "web"
+//	!(label.env == "prod") || cpus >= 4
+//
+// facts are referred to by their json names, labels by label.<key> and the host
+// name by name, a name on its own is true when it has a value
+type selector struct {
+	src  string
+	root selectorNode
+}
+
+type selectorNode interface {
+	eval(env map[string]string) bool
+}
+
+func parseSelector(src string) (*selector, error) {
+	toks, err := lexSelector(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &selectorParser{toks: toks}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q in selector", p.toks[p.pos].val)
+	}
+
+	return &selector{src: src, root: root}, nil
+}
+
+// Match returns true if the host matches the selector
+func (sel *selector) Match(h *host) bool {
+	return sel.root.eval(selectorEnv(h))
+}
+
+// selectorEnv flattens the host into the names that a selector can use
+func selectorEnv(h *host) map[string]string {
+	env := map[string]string{"name": h.Name, "state": string(h.State)}
+
+	if h.Facts != nil {
+		var facts map[string]interface{}
+		data, _ := json.Marshal(h.Facts)
+		json.Unmarshal(data, &facts)
+
+		for k, v := range facts {
+			switch v := v.(type) {
+			case nil:
+			case string:
+				env[k] = v
+			case []interface{}:
+				vals := make([]string, len(v))
+				for i := range v {
+					vals[i] = fmt.Sprint(v[i])
+				}
+				env[k] = strings.Join(vals, ",")
+			default:
+				env[k] = fmt.Sprint(v)
+			}
+		}
+	}
+
+	for k, v := range h.Labels {
+		env["label."+k] = v
+	}
+
+	return env
+}
+
+type selectorToken struct {
+	kind string // op, str, word
+	val  string
+}
+
+var selectorOps = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+func lexSelector(src string) ([]selectorToken, error) {
+	var toks []selectorToken
+	s := src
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			return toks, nil
+		}
+
+		switch s[0] {
+		case '"':
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, errors.New("unterminated string in selector")
+			}
+
+			v, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, errors.New("invalid string in selector: " + s[:end+1])
+			}
+			toks = append(toks, selectorToken{"str", v})
+			s = s[end+1:]
+			continue
+
+		case '\'':
+			end := strings.IndexByte(s[1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated string in selector")
+			}
+			toks = append(toks, selectorToken{"str", s[1 : end+1]})
+			s = s[end+2:]
+			continue
+		}
+
+		op := ""
+		for _, o := range selectorOps {
+			if strings.HasPrefix(s, o) {
+				op = o
+				break
+			}
+		}
+
+		if op != "" {
+			toks = append(toks, selectorToken{"op", op})
+			s = s[len(op):]
+			continue
+		}
+
+		end := strings.IndexFunc(s, func(r rune) bool {
+			return !(r == '_' || r == '.' || r == '-' || r == '/' || r == ':' ||
+				(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'))
+		})
+		switch end {
+		case 0:
+			return nil, fmt.Errorf("unexpected %q in selector", s[:1])
+		case -1:
+			end = len(s)
+		}
+
+		toks = append(toks, selectorToken{"word", s[:end]})
+		s = s[end:]
+	}
+}
+
+type selectorParser struct {
+	toks []selectorToken
+	pos  int
+}
+
+func (p *selectorParser) peek(op string) bool {
+	return p.pos < len(p.toks) && p.toks[p.pos].kind == "op" && p.toks[p.pos].val == op
+}
+
+func (p *selectorParser) or() (selectorNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek("||") {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *selectorParser) and() (selectorNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek("&&") {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *selectorParser) unary() (selectorNode, error) {
+	switch {
+	case p.peek("!"):
+		p.pos++
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+
+	case p.peek("("):
+		p.pos++
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, errors.New("missing ) in selector")
+		}
+		p.pos++
+		return n, nil
+	}
+
+	if p.pos >= len(p.toks) {
+		return nil, errors.New("selector ended unexpectedly")
+	}
+
+	name := p.toks[p.pos]
+	if name.kind != "word" {
+		return nil, fmt.Errorf("expected a name in selector but got %q", name.val)
+	}
+	p.pos++
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if !p.peek(op) {
+			continue
+		}
+		p.pos++
+
+		if p.pos >= len(p.toks) || p.toks[p.pos].kind == "op" {
+			return nil, fmt.Errorf("expected a value after %s in selector", op)
+		}
+		val := p.toks[p.pos].val
+		p.pos++
+
+		return cmpNode{name.val, op, val}, nil
+	}
+
+	return hasNode{name.val}, nil
+}
+
+type orNode struct{ left, right selectorNode }
+type andNode struct{ left, right selectorNode }
+type notNode struct{ n selectorNode }
+type hasNode struct{ name string }
+type cmpNode struct{ name, op, val string }
+
+func (n orNode) eval(env map[string]string) bool  { return n.left.eval(env) || n.right.eval(env) }
+func (n andNode) eval(env map[string]string) bool { return n.left.eval(env) && n.right.eval(env) }
+func (n notNode) eval(env map[string]string) bool { return !n.n.eval(env) }
+
+func (n hasNode) eval(env map[string]string) bool {
+	v := env[n.name]
+	return v != "" && v != "false"
+}
+
+func (n cmpNode) eval(env map[string]string) bool {
+	v, ok := env[n.name]
+	switch n.op {
+	case "==":
+		return ok && v == n.val
+	case "!=":
+		return !ok || v != n.val
+	}
+
+	// ordering only makes sense for numbers
+	a, err1 := strconv.ParseFloat(v, 64)
+	b, err2 := strconv.ParseFloat(n.val, 64)
+	if !ok || err1 != nil || err2 != nil {
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	default:
+		return a >= b
+	}
+}
@@ -0,0 +1,79 @@
+package nansibled
+
+import "testing"
+
+func TestParseSelectorErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		ok  bool
+	}{
+		{`os_family == "Debian"`, true},
+		{`label.role == 'web' && cpus >= 4`, true},
+		{`!(label.env == "prod") || name`, true},
+		{`label.zone == eu-west-1a`, true},
+		{`os_family ==`, false},
+		{`os_family == == "x"`, false},
+		{`(cpus > 2`, false},
+		{`cpus > 2)`, false},
+		{`"Debian"`, false},
+		{`os == "unterminated`, false},
+		{`os == 'unterminated`, false},
+		{`cpus $ 2`, false},
+		{`&& cpus`, false},
+		{``, false},
+	}
+
+	for _, tt := range tests {
+		_, err := parseSelector(tt.src)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseSelector(%q) error = %v, want ok %v", tt.src, err, tt.ok)
+		}
+	}
+}
+
+func TestSelectorMatch(t *testing.T) {
+	h := &host{
+		Name:   "web1",
+		Labels: map[string]string{"role": "web", "env": "prod"},
+		Facts: &Facts{
+			OSFamily: "Debian",
+			CPUs:     4,
+			IPs:      []string{"10.0.0.1", "10.0.0.2"},
+		},
+	}
+
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{`os_family == "Debian"`, true},
+		{`os_family != "Debian"`, false},
+		{`os_family == "RedHat"`, false},
+		{`label.role == "web" && label.env == "prod"`, true},
+		{`label.role == "db" || label.env == "prod"`, true},
+		{`!(label.env == "prod")`, false},
+		{`label.missing != "x"`, true},
+		{`label.missing == "x"`, false},
+		{`label.role`, true},
+		{`label.missing`, false},
+		{`cpus >= 4`, true},
+		{`cpus > 4`, false},
+		{`cpus < 8 && cpus <= 4`, true},
+		{`os_family > 2`, false},
+		{`ips == "10.0.0.1,10.0.0.2"`, true},
+		{`name == web1`, true},
+		{`label.role == "db" || label.env == "dev" && cpus > 1`, false},
+		{`(label.role == "db" || label.env == "prod") && cpus > 1`, true},
+	}
+
+	for _, tt := range tests {
+		sel, err := parseSelector(tt.src)
+		if err != nil {
+			t.Fatalf("parseSelector(%q): %v", tt.src, err)
+		}
+
+		if got := sel.Match(h); got != tt.want {
+			t.Errorf("%q matched %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
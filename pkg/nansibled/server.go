@@ -1,6 +1,10 @@
 package nansibled
 
 import (
+	"crypto/ed25519"
+	"sync"
+	"time"
+
 	"github.com/albrow/zoom"
 	"github.com/gin-gonic/gin"
 	"github.com/nats-io/nats.go"
@@ -10,16 +14,49 @@ type Server struct {
 	nc *nats.Conn
 	db *db
 
-	running []*deploy
+	rmu     sync.Mutex
+	running map[string]*deploy
+	pbmu    sync.Mutex
+
+	signer    *signingKeys
+	signGrace time.Duration
+
+	pmu        sync.Mutex
+	promotions map[string]chan string
+
+	cmu     sync.Mutex
+	cancels map[string]*cancellation
+
+	secretsKey *[32]byte
 }
 
 func NewServer(nc *nats.Conn, pool *zoom.Pool) *Server {
-	svr := &Server{nc: nc}
+	svr := &Server{nc: nc, running: map[string]*deploy{}, cancels: map[string]*cancellation{}}
 	svr.db = newDB(pool)
 
+	return svr
+}
+
+// Start listens for agents and runs the background loops, it should only be
+// called once the signing and secrets keys are loaded
+func (svr *Server) Start(driftInterval time.Duration) {
+	svr.abandonRuns()
+
+	svr.collectLogs()
+	svr.collectFacts()
+	svr.serveArtifacts()
+
 	go svr.identifyHosts()
+	go svr.runSchedules()
+	svr.watchDrift(driftInterval)
+}
 
-	return svr
+// signers returns the keys that messages to agents should be signed with
+func (svr *Server) signers() []ed25519.PrivateKey {
+	if svr.signer == nil {
+		return nil
+	}
+	return svr.signer.active(svr.signGrace)
 }
 
 func (svr *Server) SetupRoutes(api gin.IRouter) {
@@ -27,29 +64,72 @@ func (svr *Server) SetupRoutes(api gin.IRouter) {
 
 	api.GET("/playbooks/", findAllModelsHandler(svr.db.playbooks, new([]*playbook)))
 	api.GET("/playbooks/:name", findModelHandler(svr.db.playbooks.Find, new(playbook), "name"))
-	api.DELETE("/playbooks/:name", deleteModelHandler(svr.db.playbooks))
-	api.POST("/playbooks")
+	api.DELETE("/playbooks/:name", svr.handleDeletePlaybook)
+	api.POST("/playbooks", svr.handleUploadPlaybook)
+	api.GET("/playbooks/:name/versions", svr.handlePlaybookVersions)
+	api.GET("/playbooks/:name/versions/:n", svr.handlePlaybookVersion)
 	api.POST("/playbooks/:name/group/:group")
 	api.DELETE("/playbooks/:name/group/:group")
 
-	api.GET("/hosts", findAllModelsHandler(svr.db.hosts, new([]*host)))
+	api.GET("/hosts", svr.handleListHosts)
 	api.PUT("/hosts/:host", findModelHandler(svr.db.hosts.Find, new(host), "name"))
+	api.PUT("/hosts/:host/key", svr.handleSetHostKey)
 	api.PUT("/hosts/:host/deploy/:playbook", svr.handleHostDeploy)
+	api.PUT("/hosts/:host/rollback/:playbook", svr.handleRollbackHost)
+	api.PUT("/hosts/:host/check", svr.handleCheckHostDrift)
+	api.GET("/hosts/:host/facts", svr.handleHostFacts)
+	api.PUT("/hosts/:host/facts/refresh", svr.handleRefreshFacts)
+	api.GET("/hosts/:host/vars", svr.handleHostVars)
+	api.PUT("/hosts/:host/vars", svr.handleSetHostVars)
+	api.PUT("/hosts/:host/labels/:key", svr.handleSetLabel)
+	api.DELETE("/hosts/:host/labels/:key", svr.handleDeleteLabel)
 	api.POST("/hosts/:host/group/:group", svr.handleAddHostToGroup)
 	api.DELETE("/hosts/:host/group/:group", svr.handleRmHostFromGroup)
 
 	api.GET("/groups", findAllModelsHandler(svr.db.groups, new([]*group)))
-	api.GET("/groups/:name", findModelHandler(svr.db.groups.Find, new(group), "name"))
+	api.GET("/groups/:name", svr.handleGetGroup)
 	api.POST("/groups", svr.handleCreateNewGroup)
 	api.DELETE("/groups/:name", deleteModelHandler(svr.db.groups))
 	api.PUT("/groups/:name")
 	api.POST("/groups/:name/host/:host", svr.handleAddHostToGroup)
 	api.DELETE("/groups/:name/host/:host", svr.handleRmHostFromGroup)
+	api.PUT("/groups/:name/selector", svr.handleSetGroupSelector)
+	api.POST("/groups/:name/children/:child", svr.handleAddChildGroup)
+	api.DELETE("/groups/:name/children/:child", svr.handleRmChildGroup)
+	api.GET("/groups/:name/vars", svr.handleGroupVars)
+	api.PUT("/groups/:name/vars", svr.handleSetGroupVars)
 	api.PUT("/groups/:name/playbook/:playbook", updateAttributeHandler(svr.db.groups, new(group), "playbook", "playbook"))
 	api.PUT("/groups/:name/deploy", svr.handleDeployGroup)
+	api.PUT("/groups/:name/rollback", svr.handleRollbackGroup)
+	api.PUT("/groups/:name/cancel", svr.handleCancelGroup)
+	api.PUT("/groups/:name/promote", svr.handlePromoteGroup)
+	api.GET("/groups/:name/drift", svr.handleGroupDrift)
 
 	// api.GET("/requests", findAllModelsHandler(svr.db.reqs, new([]*http.Request)))
 	api.GET("/deploys", findAllModelsHandler(svr.db.deploys, new([]*deploy)))
 	api.GET("/deploys/:name", findModelHandler(svr.db.deploys.Find, new(deploy), "name"))
 	api.GET("/deploys/:name/running", svr.handleRunningDeploys)
+	api.GET("/deploys/:name/log", svr.handleDeployLog)
+	api.PUT("/deploys/:name/cancel", svr.handleCancelDeploy)
+
+	api.PUT("/deploy", svr.handleDeploySelector)
+
+	api.GET("/secrets", svr.handleListSecrets)
+	api.GET("/secrets/:name", svr.handleGetSecret)
+	api.PUT("/secrets/:name", svr.handlePutSecret)
+	api.DELETE("/secrets/:name", svr.handleDeleteSecret)
+
+	api.GET("/inventory", svr.handleInventory)
+
+	api.GET("/runs", svr.handleListRuns)
+	api.GET("/runs/:id", svr.handleGetRun)
+	api.POST("/runs/:id/retry-failed", svr.handleRetryFailed)
+
+	api.GET("/schedules", svr.handleListSchedules)
+	api.GET("/schedules/:id", findModelHandler(svr.db.schedules.Find, new(schedule), "id"))
+	api.POST("/schedules", svr.handleCreateSchedule)
+	api.PUT("/schedules/:id", svr.handleUpdateSchedule)
+	api.DELETE("/schedules/:id", svr.handleDeleteSchedule)
+	api.PUT("/schedules/:id/pause", svr.handlePauseSchedule(true))
+	api.PUT("/schedules/:id/resume", svr.handlePauseSchedule(false))
 }
@@ -0,0 +1,151 @@
+package nansibled
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+var (
+	ErrNotSigned    = errors.New("message is not signed")
+	ErrBadSignature = errors.New("message signature is not from a trusted key")
+	ErrNoTrustedKey = errors.New("no trusted server keys configured")
+)
+
+// signingKeys are the keys the server signs messages with, the previous key is
+// kept for a grace period after rotating so agents can be moved to the new key
+type signingKeys struct {
+	Current   ed25519.PrivateKey `json:"current"`
+	Previous  ed25519.PrivateKey `json:"previous,omitempty"`
+	RotatedAt time.Time          `json:"rotated_at,omitempty"`
+}
+
+func loadSigningKeys(fn string) (*signingKeys, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	sk := new(signingKeys)
+	if err := json.Unmarshal(data, sk); err != nil {
+		return nil, err
+	}
+
+	if len(sk.Current) != ed25519.PrivateKeySize {
+		return nil, ErrInvalidKey
+	}
+
+	return sk, nil
+}
+
+func (sk *signingKeys) save(fn string) error {
+	data, err := json.MarshalIndent(sk, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := fn + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, fn)
+}
+
+// rotate replaces the current key with a new one, keeping the current key as the previous
+func (sk *signingKeys) rotate() error {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	sk.Previous = sk.Current
+	sk.Current = priv
+	sk.RotatedAt = time.Now()
+	return nil
+}
+
+// active returns the keys that messages should currently be signed with
+func (sk *signingKeys) active(grace time.Duration) []ed25519.PrivateKey {
+	keys := []ed25519.PrivateKey{sk.Current}
+	if len(sk.Previous) == ed25519.PrivateKeySize && time.Since(sk.RotatedAt) < grace {
+		keys = append(keys, sk.Previous)
+	}
+	return keys
+}
+
+// EncodePublicKey base64 encodes the public half of a signing key
+func EncodePublicKey(priv ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+}
+
+// ParsePublicKey decodes a base64 encoded ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		return nil, ErrInvalidKey
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// SignedMessage wraps a message with signatures of its exact bytes, so that they
+// can be checked without the agent and server agreeing on every field
+type SignedMessage struct {
+	Message    json.RawMessage `json:"message"`
+	Signatures []string        `json:"signatures"`
+}
+
+// Signed returns the message wrapped with a signature from each of the given keys
+func (nsg NansibleMessage) Signed(keys ...ed25519.PrivateKey) []byte {
+	sm := SignedMessage{Message: nsg.Bytes(), Signatures: []string{}}
+	for _, k := range keys {
+		sm.Signatures = append(sm.Signatures, base64.StdEncoding.EncodeToString(ed25519.Sign(k, sm.Message)))
+	}
+
+	data, _ := json.Marshal(sm)
+	return data
+}
+
+// ParseSigned parses a signed message, checking that it was signed by at least one
+// of the trusted keys, the message is returned even when it isn't trusted so that
+// it can be refused
+func ParseSigned(data []byte, trusted []ed25519.PublicKey) (NansibleMessage, error) {
+	var sm SignedMessage
+	if err := json.Unmarshal(data, &sm); err != nil {
+		return NansibleMessage{}, err
+	}
+
+	if len(sm.Message) == 0 {
+		nsg, _ := ParseNanMsg(data)
+		return nsg, ErrNotSigned
+	}
+
+	nsg, err := ParseNanMsg(sm.Message)
+	switch {
+	case err != nil:
+		return nsg, err
+	case len(trusted) == 0:
+		return nsg, ErrNoTrustedKey
+	case len(sm.Signatures) == 0:
+		return nsg, ErrNotSigned
+	}
+
+	for _, s := range sm.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			continue
+		}
+
+		for _, pk := range trusted {
+			if ed25519.Verify(pk, sm.Message, sig) {
+				return nsg, nil
+			}
+		}
+	}
+
+	return nsg, ErrBadSignature
+}
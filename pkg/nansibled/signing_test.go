@@ -0,0 +1,132 @@
+package nansibled
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newSigningKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func public(priv ed25519.PrivateKey) ed25519.PublicKey { return priv.Public().(ed25519.PublicKey) }
+
+func TestParseSigned(t *testing.T) {
+	key, other := newSigningKey(t), newSigningKey(t)
+	nsg := NansibleMessage{Host: "web1", Deploy: "abc", Payload: "<sealed & 🔑>"}
+
+	// a newer server may send fields this agent doesn't know about
+	future, _ := json.Marshal(map[string]interface{}{"host": "web1", "deploy": "abc", "new_field": []int{1, 2}})
+	futureMsg := SignedMessage{Message: future}
+	futureMsg.Signatures = []string{base64.StdEncoding.EncodeToString(ed25519.Sign(key, future))}
+	futureData, _ := json.Marshal(futureMsg)
+
+	tampered := bytes.Replace(nsg.Signed(key), []byte("web1"), []byte("web2"), 1)
+
+	tests := []struct {
+		desc    string
+		data    []byte
+		trusted []ed25519.PublicKey
+		err     error
+	}{
+		{"signed", nsg.Signed(key), []ed25519.PublicKey{public(key)}, nil},
+		{"one of the keys", nsg.Signed(other, key), []ed25519.PublicKey{public(key)}, nil},
+		{"one of the trusted", nsg.Signed(key), []ed25519.PublicKey{public(other), public(key)}, nil},
+		{"unknown fields", futureData, []ed25519.PublicKey{public(key)}, nil},
+		{"untrusted key", nsg.Signed(other), []ed25519.PublicKey{public(key)}, ErrBadSignature},
+		{"tampered", tampered, []ed25519.PublicKey{public(key)}, ErrBadSignature},
+		{"no signatures", nsg.Signed(), []ed25519.PublicKey{public(key)}, ErrNotSigned},
+		{"plain message", nsg.Bytes(), []ed25519.PublicKey{public(key)}, ErrNotSigned},
+		{"nothing trusted", nsg.Signed(key), nil, ErrNoTrustedKey},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSigned(tt.data, tt.trusted)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.desc, err, tt.err)
+		}
+
+		// the message comes back even when it isn't trusted so it can be refused
+		if got.Deploy != "abc" {
+			t.Errorf("%s: message was not returned: %+v", tt.desc, got)
+		}
+	}
+
+	got, _ := ParseSigned(nsg.Signed(key), []ed25519.PublicKey{public(key)})
+	if got.Payload != nsg.Payload {
+		t.Errorf("payload = %q, want %q", got.Payload, nsg.Payload)
+	}
+}
+
+func TestSigningKeysRotate(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "signing.key")
+	sk := &signingKeys{Current: newSigningKey(t)}
+	if err := sk.save(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := sk.active(time.Hour); len(keys) != 1 {
+		t.Fatalf("%d active keys before rotating, want 1", len(keys))
+	}
+
+	old := sk.Current
+	if err := sk.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sk.save(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadSigningKeys(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !loaded.Previous.Equal(old) || loaded.Current.Equal(old) {
+		t.Fatal("rotating didn't keep the old key as the previous one")
+	}
+
+	// agents that only trust the old key keep working during the grace period
+	nsg := NansibleMessage{Host: "web1"}
+	if _, err := ParseSigned(nsg.Signed(loaded.active(time.Hour)...), []ed25519.PublicKey{public(old)}); err != nil {
+		t.Errorf("message during the grace period: %v", err)
+	}
+
+	if _, err := ParseSigned(nsg.Signed(loaded.active(time.Hour)...), []ed25519.PublicKey{public(loaded.Current)}); err != nil {
+		t.Errorf("message to an agent trusting the new key: %v", err)
+	}
+
+	loaded.RotatedAt = time.Now().Add(-2 * time.Hour)
+	if keys := loaded.active(time.Hour); len(keys) != 1 || !keys[0].Equal(loaded.Current) {
+		t.Fatal("the old key was still used after the grace period")
+	}
+
+	if _, err := ParseSigned(nsg.Signed(loaded.active(time.Hour)...), []ed25519.PublicKey{public(old)}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("message after the grace period to an agent trusting the old key: %v", err)
+	}
+}
+
+func TestLoadSigningKeysInvalid(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "signing.key")
+	if _, err := loadSigningKeys(fn); err == nil {
+		t.Error("expected an error for a missing key file")
+	}
+
+	sk := &signingKeys{Current: ed25519.PrivateKey("short")}
+	sk.save(fn)
+	if _, err := loadSigningKeys(fn); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("got %v for a short key, want ErrInvalidKey", err)
+	}
+}
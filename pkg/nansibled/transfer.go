@@ -0,0 +1,208 @@
+package nansibled
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var (
+	ErrArtifactNotFound = errors.New("artifact not found")
+	ErrBadChecksum      = errors.New("checksum does not match")
+
+	// ArtifactChunkSize is how much of an artifact is sent in each reply
+	ArtifactChunkSize int64 = 256 << 10
+
+	// artifactTTL is how long an artifact is kept after it was last deployed
+	artifactTTL = 24 * time.Hour
+
+	// artifactAckTimeout is how long the host gets to fetch a referenced payload
+	// and ack the deploy
+	artifactAckTimeout = 5 * time.Minute
+)
+
+// Checksum returns the hex encoded sha256 of the data
+func Checksum(data []byte) string { return fmt.Sprintf("%x", sha256.Sum256(data)) }
+
+// validHash returns true if the string looks like a hash made by Checksum
+func validHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+func artifactKey(hash string) string    { return "nansible:artifact:" + hash }
+func artifactKeyKey(hash string) string { return "nansible:artifactkey:" + hash }
+
+// saveArtifact stores the content encrypted under a key made for it, so that it is
+// kept once no matter how many hosts it is sent to, and returns the key and the
+// size of what the hosts will fetch
+func (db *db) saveArtifact(hash string, data []byte) (*[32]byte, int64, error) {
+	conn := db.pool.NewConn()
+	defer conn.Close()
+
+	ttl := int(artifactTTL.Seconds())
+
+	// the first deploy of the content makes the key, the rest use the same one
+	key := new([32]byte)
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, 0, err
+	}
+
+	created, err := conn.Do("SET", artifactKeyKey(hash), key[:], "NX", "EX", ttl)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stored, err := redis.Bytes(conn.Do("GET", artifactKeyKey(hash)))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(stored) != len(key) {
+		return nil, 0, errors.New("invalid artifact key for " + hash)
+	}
+	copy(key[:], stored)
+
+	sealed, err := sealArtifact(data, key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// a new key means any stored content was sealed with a key that has expired
+	args := []interface{}{artifactKey(hash), sealed, "EX", ttl}
+	if created == nil {
+		args = append(args, "NX")
+	}
+
+	if _, err := conn.Do("SET", args...); err != nil {
+		return nil, 0, err
+	}
+
+	// keep them around for as long as they are being deployed
+	conn.Do("EXPIRE", artifactKeyKey(hash), ttl)
+	conn.Do("EXPIRE", artifactKey(hash), ttl)
+
+	size, err := redis.Int64(conn.Do("STRLEN", artifactKey(hash)))
+	return key, size, err
+}
+
+// sealArtifact encrypts the content with the artifact's key, prefixed by the nonce
+func sealArtifact(data []byte, key *[32]byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], data, &nonce, key), nil
+}
+
+// OpenArtifact decrypts an artifact fetched from the server with its key
+func OpenArtifact(sealed, key []byte) ([]byte, error) {
+	if len(sealed) < 24 || len(key) != 32 {
+		return nil, ErrCantDecrypt
+	}
+
+	var nonce [24]byte
+	var k [32]byte
+	copy(nonce[:], sealed[:24])
+	copy(k[:], key)
+
+	data, ok := secretbox.Open(nil, sealed[24:], &nonce, &k)
+	if !ok {
+		return nil, ErrCantDecrypt
+	}
+	return data, nil
+}
+
+// readArtifact returns the chunk of the artifact at the offset, along with the
+// size of the whole artifact
+func (db *db) readArtifact(hash string, offset int64) ([]byte, int64, error) {
+	if !validHash(hash) {
+		return nil, 0, ErrArtifactNotFound
+	}
+
+	conn := db.pool.NewConn()
+	defer conn.Close()
+
+	size, err := redis.Int64(conn.Do("STRLEN", artifactKey(hash)))
+	switch {
+	case err != nil:
+		return nil, 0, err
+	case size == 0:
+		return nil, 0, ErrArtifactNotFound
+	case offset < 0 || offset > size:
+		return nil, 0, errors.New("offset out of range")
+	case offset == size:
+		return []byte{}, size, nil
+	}
+
+	data, err := redis.Bytes(conn.Do("GETRANGE", artifactKey(hash), offset, offset+ArtifactChunkSize-1))
+	return data, size, err
+}
+
+// tooBig returns true if the data sealed to a host would push the message past
+// the max payload the NATS server accepts, leaving room for the rest of the message
+func tooBig(max int64, size int) bool {
+	return max > 0 && int64(base64.StdEncoding.EncodedLen(size+box.AnonymousOverhead)) > max/2
+}
+
+// attachPlaybook seals the playbook into the message for the host, if it is too
+// big to send in the message it is stored as an artifact by its content hash, and
+// only the artifact's key is sealed to the host
+func attachPlaybook(nc *nats.Conn, store *db, nsg *NansibleMessage, pb *playbook, pubkey string) error {
+	data := pb.Bytes()
+	if store == nil || !tooBig(nc.MaxPayload(), len(data)) {
+		var err error
+		nsg.Payload, err = SealPayload(pubkey, data)
+		return err
+	}
+
+	hash := Checksum(data)
+	key, size, err := store.saveArtifact(hash, data)
+	if err != nil {
+		return err
+	}
+
+	nsg.Artifact = hash
+	nsg.Size = size
+	nsg.Payload, err = SealPayload(pubkey, key[:])
+	return err
+}
+
+// serveArtifacts replies to hosts asking for chunks of artifacts, which are no
+// use without the key that was sealed to the host in the deploy
+func (svr *Server) serveArtifacts() {
+	_, err := svr.nc.Subscribe("nansible.*.artifact", func(msg *nats.Msg) {
+		req, err := ParseNanMsg(msg.Data)
+		if err != nil {
+			svr.nc.Publish(msg.Reply, NansibleMessage{Error: "invalid request"}.Bytes())
+			return
+		}
+
+		res := NansibleMessage{Host: req.Host, Artifact: req.Artifact, Offset: req.Offset}
+		data, size, err := svr.db.readArtifact(req.Artifact, req.Offset)
+		if err != nil {
+			res.Error = err.Error()
+			svr.nc.Publish(msg.Reply, res.Bytes())
+			return
+		}
+
+		res.Size = size
+		res.Payload = base64.StdEncoding.EncodeToString(data)
+		res.Checksum = Checksum(data)
+		svr.nc.Publish(msg.Reply, res.Bytes())
+	})
+
+	if err != nil {
+		log.Println("ERROR: serveArtifacts(): ", err)
+	}
+}
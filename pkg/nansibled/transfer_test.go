@@ -0,0 +1,88 @@
+package nansibled
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestArtifactSealing(t *testing.T) {
+	key, other := new([32]byte), new([32]byte)
+	rand.Read(key[:])
+	rand.Read(other[:])
+
+	data := bytes.Repeat([]byte("- hosts: all\n"), 1000)
+	sealed, err := sealArtifact(data, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := OpenArtifact(sealed, key[:])
+	if err != nil || !bytes.Equal(opened, data) {
+		t.Fatalf("OpenArtifact = %d bytes, %v", len(opened), err)
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)/2] ^= 1
+
+	tests := []struct {
+		desc   string
+		sealed []byte
+		key    []byte
+	}{
+		{"wrong key", sealed, other[:]},
+		{"short key", sealed, key[:16]},
+		{"tampered", tampered, key[:]},
+		{"truncated", sealed[:len(sealed)-1], key[:]},
+		{"only a nonce", sealed[:24], key[:]},
+		{"too short for a nonce", sealed[:10], key[:]},
+	}
+
+	for _, tt := range tests {
+		if _, err := OpenArtifact(tt.sealed, tt.key); err != ErrCantDecrypt {
+			t.Errorf("%s: got %v, want ErrCantDecrypt", tt.desc, err)
+		}
+	}
+}
+
+func TestValidHash(t *testing.T) {
+	tests := []struct {
+		hash string
+		ok   bool
+	}{
+		{Checksum([]byte("playbook")), true},
+		{"", false},
+		{Checksum([]byte("playbook"))[:62], false},
+		{Checksum([]byte("playbook")) + "00", false},
+		{strings.Repeat("zz", 32), false},
+		{"../../../../etc/passwd", false},
+		{"*", false},
+	}
+
+	for _, tt := range tests {
+		if got := validHash(tt.hash); got != tt.ok {
+			t.Errorf("validHash(%q) = %v, want %v", tt.hash, got, tt.ok)
+		}
+	}
+}
+
+func TestTooBig(t *testing.T) {
+	tests := []struct {
+		max  int64
+		size int
+		want bool
+	}{
+		{0, 10 << 20, false},
+		{1 << 20, 1 << 10, false},
+		{1 << 20, 300 << 10, false},
+		{1 << 20, 400 << 10, true},
+		{1 << 20, 1 << 20, true},
+	}
+
+	for _, tt := range tests {
+		if got := tooBig(tt.max, tt.size); got != tt.want {
+			t.Errorf("tooBig(%d, %d) = %v, want %v", tt.max, tt.size, got, tt.want)
+		}
+	}
+}
@@ -105,10 +105,6 @@ func deleteModelHandler(db *zoom.Collection) func(c *gin.Context) {
 	}
 }
 
-func encryptWithSalt(salt, playbook string) string {
-	return playbook
-}
-
 func abortWithError(c *gin.Context, code int, err error) {
 	c.Error(err)
 	c.AbortWithStatusJSON(code, map[string]string{"error": err.Error()})
@@ -127,6 +123,8 @@ func findModelHandler(find func(string, zoom.Model) error, model interface{}, pa
 			err = find(id, v)
 		case *group:
 			err = find(id, v)
+		case *schedule:
+			err = find(id, v)
 		}
 
 		if err != nil {
@@ -0,0 +1,208 @@
+package nansibled
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// varValue is an effective variable for a host and where it was set
+type varValue struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"` // group:<name>, host or deploy
+}
+
+// groupDepths returns how far each group is from the top of the group tree, so
+// parents always sort before their children
+func groupDepths(groups map[string]*group) map[string]int {
+	depths := map[string]int{}
+	var depth func(string, map[string]bool) int
+	depth = func(name string, visiting map[string]bool) int {
+		if d, ok := depths[name]; ok {
+			return d
+		}
+		if visiting[name] {
+			return 0
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+
+		d := 0
+		for _, parent := range parentsOf(groups, name) {
+			if pd := depth(parent, visiting) + 1; pd > d {
+				d = pd
+			}
+		}
+		depths[name] = d
+		return d
+	}
+
+	for name := range groups {
+		depth(name, map[string]bool{})
+	}
+	return depths
+}
+
+// inGroup returns true if the host was added to the group or matches its selector
+func inGroup(g *group, h *host) bool {
+	for _, name := range g.Hosts {
+		if name == h.Name {
+			return true
+		}
+	}
+
+	if g.Selector == "" {
+		return false
+	}
+
+	sel, err := parseSelector(g.Selector)
+	return err == nil && sel.Match(h)
+}
+
+// mergeGroupVars merges the vars of the groups and all of their ancestors, with
+// parents before their children and groups at the same depth in name order, so
+// that the vars in child groups override the ones in their parents
+func mergeGroupVars(groups map[string]*group, names []string) map[string]varValue {
+	member := map[string]bool{}
+	var addAncestors func(string)
+	addAncestors = func(name string) {
+		if member[name] || groups[name] == nil {
+			return
+		}
+		member[name] = true
+		for _, parent := range parentsOf(groups, name) {
+			addAncestors(parent)
+		}
+	}
+
+	for _, name := range names {
+		addAncestors(name)
+	}
+
+	ordered := []string{}
+	for name := range member {
+		ordered = append(ordered, name)
+	}
+
+	depths := groupDepths(groups)
+	sort.Slice(ordered, func(i, j int) bool {
+		if depths[ordered[i]] != depths[ordered[j]] {
+			return depths[ordered[i]] < depths[ordered[j]]
+		}
+		return ordered[i] < ordered[j]
+	})
+
+	vars := map[string]varValue{}
+	for _, name := range ordered {
+		for k, v := range groups[name].Vars {
+			vars[k] = varValue{v, "group:" + name}
+		}
+	}
+	return vars
+}
+
+// hostVars merges the vars for the host from its groups and their ancestors, then
+// the host itself, then the overrides given for the deploy
+func (svr *Server) hostVars(h *host, override map[string]interface{}) (map[string]varValue, error) {
+	groups, err := svr.allGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, g := range groups {
+		if inGroup(g, h) {
+			names = append(names, g.Name)
+		}
+	}
+
+	vars := mergeGroupVars(groups, names)
+	for k, v := range h.Vars {
+		vars[k] = varValue{v, "host"}
+	}
+
+	for k, v := range override {
+		vars[k] = varValue{v, "deploy"}
+	}
+
+	return vars, nil
+}
+
+// varsJSON is the vars as ansible extra-vars, without where they came from
+func varsJSON(vars map[string]varValue) ([]byte, error) {
+	if len(vars) == 0 {
+		return nil, nil
+	}
+
+	flat := map[string]interface{}{}
+	for k, v := range vars {
+		flat[k] = v.Value
+	}
+	return json.Marshal(flat)
+}
+
+// deployVars is the extra-vars json sent to the host with the playbook, which has
+// the secrets the playbook uses in it, and the secret values that were included
+func (svr *Server) deployVars(h *host, pb *playbook, override map[string]interface{}) ([]byte, []string, error) {
+	vars, err := svr.hostVars(h, override)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secrets, err := svr.hostSecrets(h, pb)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := []string{}
+	if len(secrets) > 0 {
+		m := map[string]interface{}{}
+		for k, v := range secrets {
+			m[k] = v
+			values = append(values, v)
+		}
+		vars["secrets"] = varValue{m, "secrets"}
+	}
+
+	data, err := varsJSON(vars)
+	return data, values, err
+}
+
+func (svr *Server) handleHostVars(c *gin.Context) {
+	h := new(host)
+	if err := svr.db.hosts.Find(c.Param("host"), h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	vars, err := svr.hostVars(h, nil)
+	if err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, vars)
+}
+
+func (svr *Server) handleSetHostVars(c *gin.Context) {
+	h := new(host)
+	if err := svr.db.hosts.Find(c.Param("host"), h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	vars := map[string]interface{}{}
+	if err := c.BindJSON(&vars); err != nil {
+		abortWithError(c, 400, err)
+		return
+	}
+
+	h.Vars = vars
+	if err := svr.db.hosts.SaveFields([]string{"Vars"}, h); err != nil {
+		abortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, h.Vars)
+}
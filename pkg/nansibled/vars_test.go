@@ -0,0 +1,56 @@
+package nansibled
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeGroupVars(t *testing.T) {
+	// a diamond, where web and db share a parent and are both parents of app
+	groups := map[string]*group{
+		"all":   {Name: "all", Children: []string{"web", "db"}, Vars: map[string]interface{}{"env": "prod", "port": 80, "tier": "all"}},
+		"web":   {Name: "web", Children: []string{"app"}, Vars: map[string]interface{}{"port": 8080, "tier": "web"}},
+		"db":    {Name: "db", Children: []string{"app"}, Vars: map[string]interface{}{"port": 5432}},
+		"app":   {Name: "app", Hosts: []string{"app1"}, Vars: map[string]interface{}{"tier": "app"}},
+		"other": {Name: "other", Vars: map[string]interface{}{"env": "dev"}},
+	}
+
+	tests := []struct {
+		names []string
+		want  map[string]varValue
+	}{
+		{[]string{"all"}, map[string]varValue{
+			"env": {"prod", "group:all"}, "port": {80, "group:all"}, "tier": {"all", "group:all"},
+		}},
+		{[]string{"web"}, map[string]varValue{
+			"env": {"prod", "group:all"}, "port": {8080, "group:web"}, "tier": {"web", "group:web"},
+		}},
+		{[]string{"app"}, map[string]varValue{
+			"env": {"prod", "group:all"}, "port": {8080, "group:web"}, "tier": {"app", "group:app"},
+		}},
+		{[]string{"db", "web"}, map[string]varValue{
+			"env": {"prod", "group:all"}, "port": {8080, "group:web"}, "tier": {"web", "group:web"},
+		}},
+		{[]string{"other", "app", "missing"}, map[string]varValue{
+			"env": {"dev", "group:other"}, "port": {8080, "group:web"}, "tier": {"app", "group:app"},
+		}},
+	}
+
+	for _, tt := range tests {
+		if got := mergeGroupVars(groups, tt.names); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mergeGroupVars(%v) = %v, want %v", tt.names, got, tt.want)
+		}
+	}
+
+	// the group vars shown through the API are the ones a host in the group gets
+	for name := range groups {
+		flat := map[string]interface{}{}
+		for k, v := range mergeGroupVars(groups, []string{name}) {
+			flat[k] = v.Value
+		}
+
+		if got := groupVars(groups, name); !reflect.DeepEqual(got, flat) {
+			t.Errorf("groupVars(%s) = %v, want %v", name, got, flat)
+		}
+	}
+}